@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// adminHandler serves operational state, and also pins and unpins configs
+// with POST /config/pin and /config/unpin. It must only be bound to a
+// trusted address, such as a loopback or tailnet one, never to the public
+// listener.
+func adminHandler(ttlCache *TTLCache, providers *Providers, outliers *OutlierDetector, circuits *breakerRegistry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, ttlCache.Status())
+	})
+	mux.HandleFunc("/status/providers", func(w http.ResponseWriter, r *http.Request) {
+		statuses, conflicts := providers.Status()
+		writeJSON(w, struct {
+			Providers []ProviderStatus `json:"providers"`
+			Conflicts []string         `json:"conflicts"`
+		}{statuses, conflicts})
+	})
+	mux.HandleFunc("/status/servers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, outliers.Status())
+	})
+	mux.HandleFunc("/status/circuits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, circuits.Status())
+	})
+	mux.HandleFunc("/config/history", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, providers.history.Entries())
+	})
+	mux.HandleFunc("/config/current", func(w http.ResponseWriter, r *http.Request) {
+		routes, err := providers.Routes()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, struct {
+			Version string `json:"version"`
+			Pinned  bool   `json:"pinned"`
+			Config  Config `json:"config"`
+		}{routes.Version(), providers.Pinned() != "", routes.Config()})
+	})
+	// POST /config/pin?version=... rolls back (or forward) to a config
+	// from the history; POST /config/unpin returns to the live config.
+	mux.HandleFunc("/config/pin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := providers.Pin(r.URL.Query().Get("version")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "pinned %s\n", providers.Pinned())
+	})
+	mux.HandleFunc("/config/unpin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		providers.Unpin()
+		fmt.Fprintln(w, "unpinned")
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
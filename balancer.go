@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Balancer chooses which of a service's servers handles each request.
+// It is made for the service's backends and refers to them by index, and
+// every Pick that returns a backend must be followed by a Done for it
+// once the request is over. Balancers honour the servers' weights.
+type Balancer interface {
+	// Pick returns the index of the backend to send a request to,
+	// skipping those for which exclude (if not nil) returns true, or -1
+	// if there is none.
+	Pick(exclude func(i int) bool) int
+	// Done reports that a request to backend i is over, with the time it
+	// took to get the response headers and the error if it failed.
+	Done(i int, latency time.Duration, err error)
+}
+
+// Balancer names, as given in a service's config.
+const (
+	// round-robin gives each server as many consecutive requests as its
+	// weight in turn.
+	balancerRoundRobin = "round-robin"
+	// weighted-round-robin interleaves the servers smoothly in proportion
+	// to their weights. It is the default.
+	balancerWeightedRoundRobin = "weighted-round-robin"
+	// least-outstanding picks the server with the fewest requests in
+	// flight for its weight.
+	balancerLeastOutstanding = "least-outstanding"
+	// p2c picks the less loaded of two servers chosen at random.
+	balancerP2C = "p2c"
+	// peak-ewma is p2c with the load scaled by a moving average of each
+	// server's latency that jumps up to any higher latency seen.
+	balancerPeakEWMA = "peak-ewma"
+)
+
+const (
+	// peakEWMADecay is how quickly latencies are forgotten.
+	peakEWMADecay = 10 * time.Second
+	// peakEWMADefault is the latency of a server before any is measured.
+	peakEWMADefault = 100 * time.Millisecond
+	// peakEWMAErrorPenalty is the latency counted for a failed request,
+	// so that failing fast doesn't attract traffic.
+	peakEWMAErrorPenalty = time.Second
+)
+
+// newBalancer returns the named balancer for backends, carrying on from
+// state, which may be the zero balancerState for a fresh start.
+func newBalancer(name string, backends []Backend, state balancerState) (Balancer, error) {
+	weights := make([]int, len(backends))
+	for i, b := range backends {
+		weights[i] = b.weight()
+	}
+	if state.next == nil {
+		state.next = new(atomic.Uint64)
+	}
+	if state.loads == nil {
+		state.loads = make([]*serverLoad, len(backends))
+		for i := range state.loads {
+			state.loads[i] = &serverLoad{}
+		}
+	}
+	switch name {
+	case balancerRoundRobin:
+		return &scheduleBalancer{schedule: blockSchedule(weights), next: state.next}, nil
+	case "", balancerWeightedRoundRobin:
+		return &scheduleBalancer{schedule: smoothSchedule(weights), next: state.next}, nil
+	case balancerLeastOutstanding:
+		return newLoadBalancer(weights, state.loads, false, false), nil
+	case balancerP2C:
+		return newLoadBalancer(weights, state.loads, true, false), nil
+	case balancerPeakEWMA:
+		return newLoadBalancer(weights, state.loads, true, true), nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", name)
+}
+
+// balancerState is what a service's balancer keeps across config
+// refreshes: its place in its schedule and the load on each backend.
+// Route tables compiled for the same service share it, so that requests
+// still in flight on an old table are counted by the new one.
+type balancerState struct {
+	next  *atomic.Uint64
+	loads []*serverLoad
+}
+
+// serverLoad is the load on a server seen by load based balancers.
+type serverLoad struct {
+	outstanding atomic.Int64
+	latency     peakEWMA
+}
+
+// balancerRegistry holds the balancer state of every service, by service
+// and server URL.
+type balancerRegistry struct {
+	mutex sync.Mutex
+	next  map[string]*atomic.Uint64
+	loads map[serverKey]*serverLoad
+}
+
+func newBalancerRegistry() *balancerRegistry {
+	return &balancerRegistry{next: map[string]*atomic.Uint64{}, loads: map[serverKey]*serverLoad{}}
+}
+
+func (r *balancerRegistry) get(service string, backends []Backend) balancerState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	state := balancerState{next: r.next[service], loads: make([]*serverLoad, len(backends))}
+	if state.next == nil {
+		state.next = new(atomic.Uint64)
+		r.next[service] = state.next
+	}
+	for i, b := range backends {
+		key := serverKey{service, b.URL}
+		if r.loads[key] == nil {
+			r.loads[key] = &serverLoad{}
+		}
+		state.loads[i] = r.loads[key]
+	}
+	return state
+}
+
+// scheduleBalancer hands out backends in the order of a fixed schedule in
+// which each appears as often as its weight.
+type scheduleBalancer struct {
+	schedule []int
+	next     *atomic.Uint64
+}
+
+func (b *scheduleBalancer) Pick(exclude func(i int) bool) int {
+	// Skip the turns of excluded backends rather than giving them to the
+	// next in the schedule, so that the rest keep their proportions
+	n := uint64(len(b.schedule))
+	for k := uint64(0); k < n; k++ {
+		i := b.schedule[b.next.Add(1)%n]
+		if exclude == nil || !exclude(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *scheduleBalancer) Done(i int, latency time.Duration, err error) {}
+
+// reduceWeights divides weights by their greatest common divisor, to keep
+// schedules short.
+func reduceWeights(weights []int) []int {
+	g := 0
+	for _, w := range weights {
+		for b := w; b != 0; {
+			g, b = b, g%b
+		}
+	}
+	reduced := make([]int, len(weights))
+	for i, w := range weights {
+		if g > 0 {
+			reduced[i] = w / g
+		}
+	}
+	return reduced
+}
+
+func blockSchedule(weights []int) []int {
+	var schedule []int
+	for i, w := range reduceWeights(weights) {
+		for ; w > 0; w-- {
+			schedule = append(schedule, i)
+		}
+	}
+	return schedule
+}
+
+// smoothSchedule interleaves the backends as nginx's smooth weighted
+// round-robin does: for weights 5, 1 and 1 it is a a b a c a a.
+func smoothSchedule(weights []int) []int {
+	weights = reduceWeights(weights)
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	current := make([]int, len(weights))
+	schedule := make([]int, 0, total)
+	for len(schedule) < total {
+		best := -1
+		for i, w := range weights {
+			current[i] += w
+			if w > 0 && (best < 0 || current[i] > current[best]) {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// loadBalancer picks the backend with the lowest cost, which is its
+// outstanding requests (optionally times its peak EWMA latency) divided by
+// its weight, either out of all backends or out of two chosen at random.
+// Backends with a weight of 0 are never picked.
+type loadBalancer struct {
+	weights    []int
+	loads      []*serverLoad
+	twoChoices bool
+	ewma       bool
+}
+
+func newLoadBalancer(weights []int, loads []*serverLoad, twoChoices, ewma bool) *loadBalancer {
+	return &loadBalancer{
+		weights:    weights,
+		loads:      loads,
+		twoChoices: twoChoices,
+		ewma:       ewma,
+	}
+}
+
+func (b *loadBalancer) cost(i int) float64 {
+	load := float64(b.loads[i].outstanding.Load() + 1)
+	if b.ewma {
+		load *= b.loads[i].latency.value()
+	}
+	return load / float64(b.weights[i])
+}
+
+func (b *loadBalancer) Pick(exclude func(i int) bool) int {
+	candidates := make([]int, 0, len(b.weights))
+	for i, w := range b.weights {
+		if w > 0 && (exclude == nil || !exclude(i)) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return -1
+	}
+	if b.twoChoices && len(candidates) > 2 {
+		x := rand.IntN(len(candidates))
+		y := rand.IntN(len(candidates) - 1)
+		if y >= x {
+			y++
+		}
+		candidates = []int{candidates[x], candidates[y]}
+	}
+	// Break ties at random
+	best := -1
+	offset := rand.IntN(len(candidates))
+	for k := range candidates {
+		i := candidates[(offset+k)%len(candidates)]
+		if best < 0 || b.cost(i) < b.cost(best) {
+			best = i
+		}
+	}
+	b.loads[best].outstanding.Add(1)
+	return best
+}
+
+func (b *loadBalancer) Done(i int, latency time.Duration, err error) {
+	b.loads[i].outstanding.Add(-1)
+	if b.ewma {
+		if err != nil {
+			latency = max(latency, peakEWMAErrorPenalty)
+		}
+		b.loads[i].latency.observe(latency)
+	}
+}
+
+// peakEWMA is an exponentially weighted moving average of latency, which
+// decays with time rather than per observation, and which jumps straight
+// to any higher observation so that a server that slows down is avoided
+// at once.
+type peakEWMA struct {
+	mutex sync.Mutex
+	ns    float64
+	at    time.Time
+}
+
+func (e *peakEWMA) observe(latency time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	now := time.Now()
+	if x := float64(latency); x > e.ns {
+		e.ns = x
+	} else {
+		w := math.Exp(-float64(now.Sub(e.at)) / float64(peakEWMADecay))
+		e.ns = e.ns*w + x*(1-w)
+	}
+	e.at = now
+}
+
+func (e *peakEWMA) value() float64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.at.IsZero() {
+		return float64(peakEWMADefault)
+	}
+	return max(e.ns, 1)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func weightedBackends(weights ...int) []Backend {
+	backends := make([]Backend, len(weights))
+	for i, w := range weights {
+		backends[i].Weight = &w
+	}
+	return backends
+}
+
+func TestSchedules(t *testing.T) {
+	if got, want := smoothSchedule([]int{5, 1, 1}), []int{0, 0, 1, 0, 2, 0, 0}; !slices.Equal(got, want) {
+		t.Errorf("smooth schedule %v, want %v", got, want)
+	}
+	if got, want := blockSchedule([]int{20, 10}), []int{0, 0, 1}; !slices.Equal(got, want) {
+		t.Errorf("block schedule %v, want %v", got, want)
+	}
+}
+
+func TestBalancersHonourWeightsAndExclusions(t *testing.T) {
+	for _, name := range []string{balancerRoundRobin, balancerWeightedRoundRobin, balancerLeastOutstanding, balancerP2C, balancerPeakEWMA} {
+		b, err := newBalancer(name, weightedBackends(3, 1, 1), balancerState{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make([]int, 3)
+		// Keep every request outstanding, so that the load based
+		// balancers spread them by weight
+		for n := 0; n < 500; n++ {
+			counts[b.Pick(func(i int) bool { return i == 2 })]++
+		}
+		if counts[2] != 0 {
+			t.Errorf("%s picked an excluded backend %d times", name, counts[2])
+		}
+		if ratio := float64(counts[0]) / float64(counts[1]); ratio < 2.5 || ratio > 3.5 {
+			t.Errorf("%s picked backends %v, want a 3:1 split", name, counts)
+		}
+		if i := b.Pick(func(int) bool { return true }); i != -1 {
+			t.Errorf("%s picked %d with every backend excluded", name, i)
+		}
+	}
+}
+
+func TestDrainedBackendsGetNoRequests(t *testing.T) {
+	backends := weightedBackends(1, 0, 2)
+	for _, name := range []string{balancerRoundRobin, balancerWeightedRoundRobin, balancerLeastOutstanding, balancerP2C, balancerPeakEWMA} {
+		b, err := newBalancer(name, backends, balancerState{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < 100; n++ {
+			if i := b.Pick(nil); i == 1 {
+				t.Fatalf("%s picked the drained backend", name)
+			}
+		}
+		if i := b.Pick(func(i int) bool { return i != 1 }); i != -1 {
+			t.Errorf("%s picked %d with only the drained backend left", name, i)
+		}
+	}
+	for n := 0; n < 100; n++ {
+		if i := rendezvous(fmt.Sprint(n), backends, nil); i == 1 {
+			t.Fatalf("key %d hashed to the drained backend", n)
+		}
+	}
+}
+
+func TestBalancerStateOutlivesRouteTables(t *testing.T) {
+	registry := newBalancerRegistry()
+	backends := []Backend{{Servers: Servers{URL: "http://a"}}, {Servers: Servers{URL: "http://b"}}}
+	old, _ := newBalancer(balancerLeastOutstanding, backends, registry.get("s", backends))
+	busy := old.Pick(nil)
+
+	// A refresh that adds a server keeps the load on the others
+	backends = append(backends, Backend{Servers: Servers{URL: "http://c"}})
+	b, _ := newBalancer(balancerLeastOutstanding, backends, registry.get("s", backends))
+	for n := 0; n < 2; n++ {
+		if i := b.Pick(nil); i == busy {
+			t.Fatalf("pick %d went to the server busy with a request from the old table", n)
+		}
+	}
+	old.Done(busy, time.Millisecond, nil)
+	if i := b.Pick(nil); i != busy {
+		t.Errorf("picked %d, want %d once its request on the old table is done", i, busy)
+	}
+
+	// Round robin carries on where it was
+	rr, _ := newBalancer(balancerRoundRobin, backends, registry.get("rr", backends))
+	first := rr.Pick(nil)
+	rr, _ = newBalancer(balancerRoundRobin, backends, registry.get("rr", backends))
+	if rr.Pick(nil) == first {
+		t.Error("round robin started over after a refresh")
+	}
+}
+
+func TestPeakEWMAAvoidsSlowBackends(t *testing.T) {
+	b, _ := newBalancer(balancerPeakEWMA, weightedBackends(1, 1), balancerState{})
+	b.Done(b.Pick(func(i int) bool { return i != 0 }), time.Second, nil)
+	b.Done(b.Pick(func(i int) bool { return i != 1 }), 10*time.Millisecond, nil)
+	for n := 0; n < 20; n++ {
+		i := b.Pick(nil)
+		b.Done(i, 10*time.Millisecond, nil)
+		if i != 1 {
+			t.Fatalf("request %d went to the slow backend", n)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Built-in service types, answered by the proxy itself rather than by
+// forwarding to the service's servers.
+const (
+	// static-response answers with Status (default 200), Body and
+	// ContentType (default text/plain).
+	builtinStatic = "static-response"
+	// version answers with the proxy version and config age.
+	builtinVersion = "version"
+	// health answers 200 with the config version while the proxy has a
+	// routing config.
+	builtinHealth = "health"
+	// redirect redirects to URL with the request path and query appended,
+	// with Status (default 302).
+	builtinRedirect = "redirect"
+	// proxy-to-url forwards to URL, which unlike a server is not health
+	// checked.
+	builtinProxy = "proxy-to-url"
+)
+
+// proxyInfo is what built-in services know about the proxy.
+type proxyInfo struct {
+	Routes           *RouteTable
+	ConfigAgeSeconds float64
+}
+
+// builtin answers a request for a built-in service.
+type builtin func(w http.ResponseWriter, r *http.Request, info proxyInfo)
+
+// compileBuiltin returns the handler for a service of a built-in type, or
+// nil for a service that forwards to its servers.
+func compileBuiltin(s Services) (builtin, error) {
+	switch s.Type {
+	case "":
+		return nil, nil
+	case builtinStatic:
+		status := s.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		contentType := s.ContentType
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		return func(w http.ResponseWriter, r *http.Request, info proxyInfo) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(status)
+			io.WriteString(w, s.Body)
+		}, nil
+	case builtinVersion:
+		return func(w http.ResponseWriter, r *http.Request, info proxyInfo) {
+			w.Header().Set("X-Tiny-SSL-Version", Version)
+			w.Header().Set("X-Tiny-SSL-Config-Age", fmt.Sprintf("%.0f", info.ConfigAgeSeconds))
+			fmt.Fprintf(w, "%s\n", Version)
+		}, nil
+	case builtinHealth:
+		return func(w http.ResponseWriter, r *http.Request, info proxyInfo) {
+			writeJSON(w, map[string]interface{}{
+				"status":           "ok",
+				"version":          Version,
+				"configVersion":    info.Routes.Version(),
+				"configAgeSeconds": info.ConfigAgeSeconds,
+			})
+		}, nil
+	case builtinRedirect:
+		target := strings.TrimSuffix(s.URL, "/")
+		status := s.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+		return func(w http.ResponseWriter, r *http.Request, info proxyInfo) {
+			http.Redirect(w, r, target+r.URL.RequestURI(), status)
+		}, nil
+	case builtinProxy:
+		target, err := url.Parse(s.URL)
+		if err != nil {
+			return nil, err
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		return func(w http.ResponseWriter, r *http.Request, info proxyInfo) {
+			proxy.ServeHTTP(w, r)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", s.Type)
+}
+
+// validateBuiltin checks the settings of a service of a built-in type.
+func validateBuiltin(s Services) error {
+	if _, err := compileBuiltin(s); err != nil {
+		return err
+	}
+	switch s.Type {
+	case builtinStatic:
+		if s.Status != 0 && (s.Status < 100 || s.Status > 599) {
+			return fmt.Errorf("invalid status %d", s.Status)
+		}
+	case builtinRedirect:
+		if s.Status != 0 && (s.Status < 300 || s.Status > 399) {
+			return fmt.Errorf("invalid redirect status %d", s.Status)
+		}
+		return validateServerURL(s.URL)
+	case builtinProxy:
+		return validateServerURL(s.URL)
+	}
+	return nil
+}
+
+// builtinConfig is the routing config the proxy config starts with, for
+// the status and marketing site hosts. On other hosts /_version is
+// forwarded as usual, with the proxy version added to the response.
+func builtinConfig() Http {
+	return Http{
+		Routers: map[string]Routers{
+			"loadb.flakery.xyz": {Service: "snowflake"},
+			"www.flakery.dev":   {Service: "site"},
+			"version":           {Rule: "Host(`loadb.flakery.xyz`) && Path(`/_version`)", Service: "version"},
+		},
+		Services: map[string]Services{
+			"snowflake": {Type: builtinStatic, Body: "🌨️\n"},
+			"site":      {Type: builtinProxy, URL: "http://localhost:3000"},
+			"version":   {Type: builtinVersion},
+		},
+	}
+}
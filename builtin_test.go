@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinServices(t *testing.T) {
+	routes, err := compileConfig([]byte(`{"http":{
+		"routers":{
+			"status.flakery.xyz":{"service":"status"},
+			"old.flakery.xyz":{"service":"moved"},
+			"version":{"rule":"Host(` + "`status.flakery.xyz`" + `) && Path(` + "`/_version`" + `)","service":"version"}
+		},
+		"services":{
+			"status":{"type":"static-response","status":418,"body":"snow"},
+			"moved":{"type":"redirect","url":"https://new.flakery.xyz/","status":308},
+			"version":{"type":"version"}
+		}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, target string
+		status       int
+		header, want string
+	}{
+		{"status.flakery.xyz", "/", 418, "", "snow"},
+		{"old.flakery.xyz", "/a?b=c", 308, "Location", "https://new.flakery.xyz/a?b=c"},
+		{"status.flakery.xyz", "/_version", 200, "X-Tiny-SSL-Version", Version},
+		{"old.flakery.xyz", "/_version", 308, "Location", "https://new.flakery.xyz/_version"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		match, ok := routes.Lookup(tt.host, r)
+		if !ok || match.Service.builtin == nil {
+			t.Errorf("%s%s did not route to a built-in service", tt.host, tt.target)
+			continue
+		}
+		w := httptest.NewRecorder()
+		match.Service.builtin(w, r, proxyInfo{Routes: routes})
+		if w.Code != tt.status {
+			t.Errorf("%s%s: status %d, want %d", tt.host, tt.target, w.Code, tt.status)
+		}
+		got := w.Body.String()
+		if tt.header != "" {
+			got = w.Header().Get(tt.header)
+		}
+		if got != tt.want {
+			t.Errorf("%s%s: got %q, want %q", tt.host, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestValidateBuiltinServices(t *testing.T) {
+	_, err := compileConfig([]byte(`{"http":{
+		"routers":{"a":{"service":"a"},"b":{"service":"b"},"c":{"service":"c"}},
+		"services":{
+			"a":{"type":"teapot"},
+			"b":{"type":"redirect","url":"https://x","status":200},
+			"c":{"type":"proxy-to-url"}
+		}}}`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"service a: unknown type", "service b: invalid redirect status", "service c: server"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestBuiltinConfigHasLowestPrecedence(t *testing.T) {
+	builtins, err := newBuiltinProvider(builtinConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, tt := range []struct {
+		config, host, want string
+	}{
+		{polledConfig, "a.flakery.xyz", "a"},
+		{polledConfig, "loadb.flakery.xyz", "version"},
+		{strings.ReplaceAll(polledConfig, "a.flakery.xyz", "loadb.flakery.xyz"), "loadb.flakery.xyz", "a"},
+	} {
+		providers := NewProviders(logger, newServerStates(), &swappableProvider{mustCompile(t, tt.config)}, builtins)
+		routes, err := providers.Routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		match, ok := routes.Lookup(tt.host, httptest.NewRequest("GET", "/_version", nil))
+		if !ok || match.Service.ID != tt.want {
+			t.Errorf("%s/_version routed to %+v, want %s", tt.host, match, tt.want)
+		}
+	}
+}
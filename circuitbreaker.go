@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is the error of a request not sent because its server's
+// circuit is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// CircuitBreaker configures a circuit breaker on each server of a
+// service. A server's circuit opens when ErrorRate percent (default 50)
+// of at least MinRequests requests (default 10) in a Window (default 10s)
+// fail or take longer than Latency, if set, to respond. Requests then go
+// to other servers until, after OpenFor (default 30s), the circuit is
+// half open and lets through HalfOpenRequests (default 1), closing if
+// they all succeed. MaxRequests, if set, limits the requests in flight
+// to each server, beyond which its circuit counts as open, so that a
+// server that hangs can't tie up the proxy.
+type CircuitBreaker struct {
+	ErrorRate        float64  `json:"errorRate,omitempty"`
+	Latency          Duration `json:"latency,omitempty"`
+	MinRequests      int      `json:"minRequests,omitempty"`
+	Window           Duration `json:"window,omitempty"`
+	OpenFor          Duration `json:"openFor,omitempty"`
+	HalfOpenRequests int      `json:"halfOpenRequests,omitempty"`
+	MaxRequests      int      `json:"maxRequests,omitempty"`
+}
+
+func (c CircuitBreaker) withDefaults() *CircuitBreaker {
+	if c.ErrorRate == 0 {
+		c.ErrorRate = 50
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = 10
+	}
+	if c.Window == 0 {
+		c.Window = Duration(10 * time.Second)
+	}
+	if c.OpenFor == 0 {
+		c.OpenFor = Duration(30 * time.Second)
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = 1
+	}
+	return &c
+}
+
+func validateCircuitBreaker(c *CircuitBreaker) error {
+	if c.ErrorRate < 0 || c.ErrorRate > 100 {
+		return fmt.Errorf("circuit breaker errorRate must be between 0 and 100")
+	}
+	if c.Latency < 0 || c.MinRequests < 0 || c.Window < 0 || c.OpenFor < 0 || c.HalfOpenRequests < 0 || c.MaxRequests < 0 {
+		return fmt.Errorf("negative circuit breaker setting")
+	}
+	return nil
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	return [...]string{"closed", "open", "half-open"}[s]
+}
+
+// breaker is the circuit of a server of a service. Its state outlives
+// config changes, which only change how it is configured.
+type breaker struct {
+	mutex    sync.Mutex
+	state    circuitState
+	inFlight int
+	// requests and failures in the window starting at windowStart, while
+	// closed
+	requests, failures int
+	windowStart        time.Time
+	openUntil          time.Time
+	// probes let through and succeeded, while half open
+	probes, succeeded int
+}
+
+// update half opens the circuit once it has been open for long enough.
+func (b *breaker) update(now time.Time) {
+	if b.state == circuitOpen && !now.Before(b.openUntil) {
+		b.state, b.probes, b.succeeded = circuitHalfOpen, 0, 0
+	}
+}
+
+func (b *breaker) available(c *CircuitBreaker, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.update(now)
+	return b.availableLocked(c)
+}
+
+func (b *breaker) availableLocked(c *CircuitBreaker) bool {
+	if c.MaxRequests > 0 && b.inFlight >= c.MaxRequests {
+		return false
+	}
+	switch b.state {
+	case circuitClosed:
+		return true
+	case circuitHalfOpen:
+		return b.probes < c.HalfOpenRequests
+	}
+	return false
+}
+
+// acquire counts a request through the circuit if it may be sent, and
+// reports whether it probes a half-open circuit.
+func (b *breaker) acquire(c *CircuitBreaker, now time.Time) (probe, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.update(now)
+	if !b.availableLocked(c) {
+		return false, false
+	}
+	b.inFlight++
+	if b.state == circuitHalfOpen {
+		b.probes++
+		return true, true
+	}
+	return false, true
+}
+
+// release counts the end of an acquired request, which took latency to
+// respond, and reports whether it opened the circuit.
+func (b *breaker) release(c *CircuitBreaker, probe bool, latency time.Duration, failed bool, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.inFlight--
+	failed = failed || (c.Latency > 0 && latency > time.Duration(c.Latency))
+	switch {
+	case probe && b.state == circuitHalfOpen:
+		if failed {
+			b.open(c, now)
+			return true
+		}
+		if b.succeeded++; b.succeeded >= c.HalfOpenRequests {
+			b.state, b.requests, b.failures, b.windowStart = circuitClosed, 0, 0, now
+		}
+	case !probe && b.state == circuitClosed:
+		if now.Sub(b.windowStart) > time.Duration(c.Window) {
+			b.requests, b.failures, b.windowStart = 0, 0, now
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= c.MinRequests && float64(b.failures)*100 >= c.ErrorRate*float64(b.requests) {
+			b.open(c, now)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *breaker) open(c *CircuitBreaker, now time.Time) {
+	b.state, b.openUntil = circuitOpen, now.Add(time.Duration(c.OpenFor))
+	b.requests, b.failures = 0, 0
+}
+
+// retryAfter returns how long until the circuit half opens.
+func (b *breaker) retryAfter(now time.Time) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state != circuitOpen {
+		return 0
+	}
+	return b.openUntil.Sub(now)
+}
+
+// breakerRegistry holds the breakers of every service's servers.
+type breakerRegistry struct {
+	mutex    sync.Mutex
+	breakers map[serverKey]*breaker
+}
+
+// serverKey identifies a server of a service across config refreshes.
+type serverKey struct{ service, server string }
+
+func newBreakerRegistry() *breakerRegistry {
+	return &breakerRegistry{breakers: map[serverKey]*breaker{}}
+}
+
+func (r *breakerRegistry) get(service, server string) *breaker {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := serverKey{service, server}
+	b := r.breakers[key]
+	if b == nil {
+		b = &breaker{}
+		r.breakers[key] = b
+	}
+	return b
+}
+
+// CircuitStatus is the state of a server's circuit, for the admin
+// endpoint.
+type CircuitStatus struct {
+	Service   string     `json:"service"`
+	Server    string     `json:"server"`
+	State     string     `json:"state"`
+	InFlight  int        `json:"inFlight"`
+	Requests  int        `json:"requests"`
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"openUntil,omitempty"`
+}
+
+// Status returns the state of every circuit.
+func (r *breakerRegistry) Status() []CircuitStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	statuses := make([]CircuitStatus, 0, len(r.breakers))
+	now := time.Now()
+	for key, b := range r.breakers {
+		b.mutex.Lock()
+		b.update(now)
+		s := CircuitStatus{
+			Service:  key.service,
+			Server:   key.server,
+			State:    b.state.String(),
+			InFlight: b.inFlight,
+			Requests: b.requests,
+			Failures: b.failures,
+		}
+		if b.state == circuitOpen {
+			until := b.openUntil
+			s.OpenUntil = &until
+		}
+		b.mutex.Unlock()
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Service != statuses[j].Service {
+			return statuses[i].Service < statuses[j].Service
+		}
+		return statuses[i].Server < statuses[j].Server
+	})
+	return statuses
+}
+
+// circuitAllows reports whether backend i of s may be sent a request.
+func (s *Service) circuitAllows(i int) bool {
+	return s.circuit == nil || s.breakers[i].available(s.circuit, time.Now())
+}
+
+// circuitRetryAfter returns how long until the first of s's open circuits
+// half opens, at least a second, or 0 if s has no circuit breaker.
+func (s *Service) circuitRetryAfter() time.Duration {
+	if s.circuit == nil {
+		return 0
+	}
+	var wait time.Duration
+	now := time.Now()
+	for _, b := range s.breakers {
+		if d := b.retryAfter(now); d > 0 && (wait == 0 || d < wait) {
+			wait = d
+		}
+	}
+	return max(wait, time.Second)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	c := CircuitBreaker{
+		Latency:     Duration(100 * time.Millisecond),
+		MinRequests: 4,
+		OpenFor:     Duration(time.Minute),
+		MaxRequests: 2,
+	}.withDefaults()
+	b := &breaker{}
+	now := time.Now()
+
+	// Two of four requests are too slow
+	for n, latency := range []time.Duration{time.Millisecond, time.Second, time.Millisecond} {
+		probe, ok := b.acquire(c, now)
+		if !ok || probe {
+			t.Fatalf("request %d not let through a closed circuit", n)
+		}
+		if b.release(c, false, latency, false, now) {
+			t.Fatalf("circuit opened after request %d", n)
+		}
+	}
+	b.acquire(c, now)
+	if !b.release(c, false, time.Second, false, now) {
+		t.Fatal("circuit didn't open at a 50% failure rate")
+	}
+	if b.available(c, now.Add(59*time.Second)) {
+		t.Fatal("open circuit available")
+	}
+	if got := b.retryAfter(now); got != time.Minute {
+		t.Errorf("retry after %v, want 1m", got)
+	}
+
+	// Half open: one probe, which reopens the circuit if it fails
+	now = now.Add(time.Minute)
+	if probe, ok := b.acquire(c, now); !ok || !probe {
+		t.Fatal("no probe let through a half-open circuit")
+	}
+	if _, ok := b.acquire(c, now); ok {
+		t.Fatal("second probe let through")
+	}
+	if !b.release(c, true, time.Millisecond, true, now) {
+		t.Fatal("failed probe didn't reopen the circuit")
+	}
+	now = now.Add(time.Minute)
+	probe, _ := b.acquire(c, now)
+	b.release(c, probe, time.Millisecond, false, now)
+	if b.state != circuitClosed {
+		t.Fatalf("circuit %v after a successful probe", b.state)
+	}
+
+	// At most MaxRequests in flight
+	b.acquire(c, now)
+	b.acquire(c, now)
+	if _, ok := b.acquire(c, now); ok {
+		t.Error("more than MaxRequests let through")
+	}
+}
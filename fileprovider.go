@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileProvider serves routing config read from a local file, or from every
+// .json, .yaml and .yml file in a directory, in the same schema as
+// lb-config-ng. It polls for changes and swaps in a new route table only
+// once the changed files have parsed and compiled; a broken edit leaves
+// the previous table in place.
+type FileProvider struct {
+	Path     string
+	Interval time.Duration
+	Logger   *slog.Logger
+
+	routes atomic.Pointer[RouteTable]
+	// Fingerprints of the last load: mtimes and sizes, checked every
+	// poll, and the contents, checked when the former differ.
+	stat string
+	hash [sha256.Size]byte
+}
+
+// NewFileProvider loads path, failing if it doesn't hold a valid config.
+func NewFileProvider(path string, logger *slog.Logger) (*FileProvider, error) {
+	p := &FileProvider{
+		Path:     path,
+		Interval: 2 * time.Second,
+		Logger:   logger,
+	}
+	if _, err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *FileProvider) Routes() (*RouteTable, error) {
+	return p.routes.Load(), nil
+}
+
+// Run polls for changes until ctx is cancelled.
+func (p *FileProvider) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := p.reload()
+		if err != nil {
+			p.Logger.Error("error reloading config file, keeping previous config", "err", err, "path", p.Path)
+		} else if reloaded {
+			p.Logger.Info("reloaded config file", "path", p.Path)
+		}
+	}
+}
+
+// reload must only be called from one goroutine at a time.
+func (p *FileProvider) reload() (bool, error) {
+	files, err := configFiles(p.Path)
+	if err != nil {
+		return false, err
+	}
+	var stat strings.Builder
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(&stat, "%s %d %d\n", name, info.ModTime().UnixNano(), info.Size())
+	}
+	if stat.String() == p.stat {
+		return false, nil
+	}
+
+	h := sha256.New()
+	bodies := make([][]byte, len(files))
+	for i, name := range files {
+		if bodies[i], err = os.ReadFile(name); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(h, "%s %d\n", name, len(bodies[i]))
+		h.Write(bodies[i])
+	}
+	var hash [sha256.Size]byte
+	h.Sum(hash[:0])
+	if hash == p.hash {
+		p.stat = stat.String()
+		return false, nil
+	}
+
+	config, err := parseConfigFiles(files, bodies)
+	if err != nil {
+		return false, err
+	}
+	routes, err := compileRoutes(config)
+	if err != nil {
+		return false, err
+	}
+
+	p.routes.Store(routes)
+	p.stat = stat.String()
+	p.hash = hash
+	return true, nil
+}
+
+// loadConfigPath reads the config in path the way a FileProvider does.
+func loadConfigPath(path string) (Config, error) {
+	files, err := configFiles(path)
+	if err != nil {
+		return Config{}, err
+	}
+	bodies := make([][]byte, len(files))
+	for i, name := range files {
+		if bodies[i], err = os.ReadFile(name); err != nil {
+			return Config{}, err
+		}
+	}
+	return parseConfigFiles(files, bodies)
+}
+
+func parseConfigFiles(files []string, bodies [][]byte) (Config, error) {
+	var config Config
+	for i, name := range files {
+		c, err := parseConfigFile(name, bodies[i])
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", name, err)
+		}
+		if err := mergeFileConfig(&config, c, name); err != nil {
+			return Config{}, err
+		}
+	}
+	return config, nil
+}
+
+// configFiles returns path itself, or the config files in it if it is a
+// directory, in lexical order.
+func configFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".json", ".yaml", ".yml":
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// parseConfigFile parses JSON, or YAML if name says so.
+func parseConfigFile(name string, body []byte) (Config, error) {
+	body, err := yamlToJSON(name, body)
+	if err != nil {
+		return Config{}, err
+	}
+	return parseConfig(body)
+}
+
+// yamlToJSON converts body to JSON if name is a YAML file, so that both
+// formats share the json struct tags.
+func yamlToJSON(name string, body []byte) ([]byte, error) {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		var v interface{}
+		if err := yaml.Unmarshal(body, &v); err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	}
+	return body, nil
+}
+
+func mergeFileConfig(dst *Config, src Config, name string) error {
+	if dst.Http.Routers == nil {
+		dst.Http.Routers = map[string]Routers{}
+		dst.Http.Services = map[string]Services{}
+	}
+	for host, r := range src.Http.Routers {
+		if _, ok := dst.Http.Routers[host]; ok {
+			return fmt.Errorf("%s: router %s is already defined", name, host)
+		}
+		dst.Http.Routers[host] = r
+	}
+	for id, s := range src.Http.Services {
+		if _, ok := dst.Http.Services[id]; ok {
+			return fmt.Errorf("%s: service %s is already defined", name, id)
+		}
+		dst.Http.Services[id] = s
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fileBackend(t *testing.T, p *FileProvider, host string) string {
+	t.Helper()
+	routes, _ := p.Routes()
+	match, ok := routes.Lookup(host, httptest.NewRequest("GET", "/", nil))
+	if !ok {
+		return ""
+	}
+	return match.Service.Backends[0].URL
+}
+
+func TestFileProviderReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string, mtime time.Time) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// Make each write visible however coarse the filesystem's mtimes
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("a.json", polledConfig, start)
+	write("b.yaml", `
+http:
+  routers:
+    b.flakery.xyz:
+      service: b
+  services:
+    b:
+      servers:
+        - url: http://b:8080
+`, start)
+	write(".hidden.json", "not json", start)
+
+	p, err := NewFileProvider(dir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := fileBackend(t, p, "a.flakery.xyz"), fileBackend(t, p, "b.flakery.xyz"); a != "http://polled:8080" || b != "http://b:8080" {
+		t.Fatalf("loaded %q and %q", a, b)
+	}
+	if reloaded, err := p.reload(); reloaded || err != nil {
+		t.Errorf("unchanged files reloaded: %v %v", reloaded, err)
+	}
+
+	// Touching a file without changing it doesn't recompile
+	before, _ := p.Routes()
+	write("a.json", polledConfig, start.Add(time.Minute))
+	if reloaded, err := p.reload(); reloaded || err != nil {
+		t.Errorf("touched file reloaded: %v %v", reloaded, err)
+	}
+
+	for _, tt := range []struct {
+		name, body string
+		err        string
+		backend    string
+	}{
+		{"edit", streamedConfig, "", "http://streamed:8080"},
+		{"broken edit", `{"http":`, "a.json", "http://streamed:8080"},
+		{"invalid config", `{"http":{"routers":{"a.flakery.xyz":{"service":"missing"}}}}`, "missing", "http://streamed:8080"},
+		{"duplicate router", strings.ReplaceAll(polledConfig, "a.flakery.xyz", "b.flakery.xyz"), "already defined", "http://streamed:8080"},
+		{"fixed", polledConfig, "", "http://polled:8080"},
+	} {
+		start = start.Add(time.Minute)
+		write("a.json", tt.body, start)
+		reloaded, err := p.reload()
+		if tt.err == "" && (err != nil || !reloaded) {
+			t.Errorf("%s: reloaded %v, %v", tt.name, reloaded, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+		if got := fileBackend(t, p, "a.flakery.xyz"); got != tt.backend {
+			t.Errorf("%s: a.flakery.xyz routed to %q, want %q", tt.name, got, tt.backend)
+		}
+	}
+	if after, _ := p.Routes(); after == before {
+		t.Error("route table not replaced")
+	}
+}
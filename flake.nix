@@ -80,6 +80,7 @@
                   serviceConfig = {
 
                     ExecStart = "${app}/bin/tiny-ssl-reverse-proxy";
+                    StateDirectory = "tiny-ssl-reverse-proxy";
                     Restart = "always";
                     KillMode = "process";
                   };
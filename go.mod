@@ -5,4 +5,8 @@ go 1.22.3
 require (
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/pkg/errors v0.9.1
+	golang.org/x/net v0.34.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/text v0.21.0 // indirect
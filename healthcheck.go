@@ -22,7 +22,7 @@ type healthCheckError struct {
 var counter map[string]int = map[string]int{}
 
 // handle method for health check error
-func (e healthCheckError) Handle() error {
+func (e healthCheckError) Handle(threshold int, controlPlane ControlPlaneConfig) error {
 	fmt.Printf("Deployment: %s, Host: %s UnHealthy\n", e.DeploymentID, e.Host)
 	key := e.DeploymentID + e.Host
 	if _, ok := counter[key]; ok {
@@ -31,10 +31,10 @@ func (e healthCheckError) Handle() error {
 		counter[key] = 1
 	}
 
-	if counter[key] > 4 {
+	if counter[key] > threshold {
 		counter[key] = 0
 		fmt.Printf("Deployment: %s, Host: %s Marked UnHealthy\n", e.DeploymentID, e.Host)
-		return markHostUnhealthy(e.DeploymentID, e.Host)
+		return markHostUnhealthy(controlPlane.UnhealthyURL(e.DeploymentID), e.Host)
 	}
 	return nil
 }
@@ -58,21 +58,17 @@ func doEvery(
 
 func getIsHealthy(
 	ttlCache *TTLCache,
+	config HealthCheckConfig,
 ) func(t time.Time) error {
 	return func(t time.Time) error {
-		r, err := ttlCache.Get()
+		routes, err := ttlCache.Routes()
 		if err != nil {
 			log.Println(err)
 		}
 		if err != nil {
-			return errors.Wrap(err, "error getting cache")
+			return errors.Wrap(err, "error getting routes")
 		}
-		// fmt.Fprintf(w, "Cache: %s\n", c)
-		config, err := parseConfig(r)
-		if err != nil {
-			return errors.Wrap(err, "error parsing config")
-		}
-		for deploymentID, services := range config.Http.Services {
+		for deploymentID, services := range routes.Config().Http.Services {
 			for _, servers := range services.Servers {
 				fmt.Printf("Deployment: %s, url: %s\n", deploymentID, servers.URL)
 
@@ -83,7 +79,7 @@ func getIsHealthy(
 				host := split[0] + ":" + split[1]
 
 				fmt.Printf("Deployment: %s, Host: %s\n", deploymentID, host)
-				resp, err := http.Get(host + ":9002/metrics")
+				resp, err := http.Get(fmt.Sprintf("%s:%d%s", host, config.Port, config.Path))
 				if err != nil {
 					return healthCheckError{
 						Err:          err,
@@ -106,14 +102,14 @@ func getIsHealthy(
 	}
 }
 
-func healthCheck(ttlCache *TTLCache) error {
+func healthCheck(ttlCache *TTLCache, config HealthCheckConfig, controlPlane ControlPlaneConfig) error {
 	return doEvery(
-		5*time.Second,
-		getIsHealthy(ttlCache),
+		time.Duration(config.Interval),
+		getIsHealthy(ttlCache, config),
 		func(err error) {
 			switch e := err.(type) {
 			case healthCheckError:
-				err2 := e.Handle()
+				err2 := e.Handle(config.Threshold, controlPlane)
 				if err2 != nil {
 					log.Println(err2)
 				}
@@ -128,7 +124,7 @@ type UnhealthyHost struct {
 	Host string
 }
 
-func markHostUnhealthy(deployment string, targetHost string) error {
+func markHostUnhealthy(url string, targetHost string) error {
 
 	// Create the HTTP client
 	client := http.Client{}
@@ -139,17 +135,8 @@ func markHostUnhealthy(deployment string, targetHost string) error {
 		return errors.Wrap(err, "error marshalling json")
 	}
 
-	apihost := os.Getenv("FLAKERY_BASE_URL")
-	if apihost == "" {
-		fmt.Println("FLAKERY_BASE_URL not set, using default")
-		apihost = "http://localhost:3000"
-	}
-
 	// Construct the request
-	req, err := http.NewRequest("POST", fmt.Sprintf(
-		"%s/api/deployments/target/unhealthy/%s",
-		apihost, deployment,
-	), bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		return errors.Wrap(err, "error creating request")
 	}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckReportsUnhealthyHosts(t *testing.T) {
+	var healthy sync.Map
+	metrics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := healthy.Load(r.URL.Path); !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer metrics.Close()
+	u, _ := url.Parse(metrics.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	var (
+		mutex    sync.Mutex
+		reported []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"http":{"routers":{"a.flakery.xyz":{"service":"a"}},"services":{"a":{"servers":[{"url":"http://127.0.0.1:8080"}]}}}}`)
+	})
+	mux.HandleFunc("/unhealthy/", func(w http.ResponseWriter, r *http.Request) {
+		var host UnhealthyHost
+		json.NewDecoder(r.Body).Decode(&host)
+		mutex.Lock()
+		defer mutex.Unlock()
+		reported = append(reported, r.URL.Path+" "+host.Host+" "+r.Header.Get("Authorization"))
+	})
+	controlPlane := httptest.NewServer(mux)
+	defer controlPlane.Close()
+	t.Setenv("FLAKERY_API_KEY", "key")
+	counter = map[string]int{}
+
+	cache := NewTTLCache(controlPlane.URL+"/config", time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	firstRoutes(t, cache)
+	config := HealthCheckConfig{Port: port, Path: "/metrics", Threshold: 2}
+	check := getIsHealthy(cache, config)
+	cp := ControlPlaneConfig{BaseURL: controlPlane.URL, UnhealthyPath: "/unhealthy/"}
+
+	// A host is reported once it has failed more than Threshold checks
+	for n := 1; n <= 3; n++ {
+		err, ok := check(time.Now()).(healthCheckError)
+		if !ok || err.DeploymentID != "a" || err.Host != "127.0.0.1" {
+			t.Fatalf("check %d: got %v", n, err)
+		}
+		if err := err.Handle(config.Threshold, cp); err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		if got := len(reported); (n < 3 && got != 0) || (n == 3 && got != 1) {
+			t.Errorf("check %d: %d reports", n, got)
+		}
+		mutex.Unlock()
+	}
+	if want := "/unhealthy/a 127.0.0.1 Bearer key"; reported[0] != want {
+		t.Errorf("reported %q, want %q", reported[0], want)
+	}
+
+	healthy.Store("/metrics", true)
+	if err := check(time.Now()); err != nil {
+		t.Errorf("healthy host failed its check: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// configVersion identifies a config by its content. encoding/json sorts
+// map keys, so equal configs always get the same version.
+func configVersion(c Config) string {
+	body, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:6])
+}
+
+// ConfigDiff lists what changed between two configs.
+type ConfigDiff struct {
+	RoutersAdded    []string            `json:"routersAdded,omitempty"`
+	RoutersRemoved  []string            `json:"routersRemoved,omitempty"`
+	RoutersChanged  []string            `json:"routersChanged,omitempty"`
+	ServicesAdded   []string            `json:"servicesAdded,omitempty"`
+	ServicesRemoved []string            `json:"servicesRemoved,omitempty"`
+	ServicesChanged []string            `json:"servicesChanged,omitempty"`
+	ServersAdded    map[string][]string `json:"serversAdded,omitempty"`
+	ServersRemoved  map[string][]string `json:"serversRemoved,omitempty"`
+	// ServersReweighted lists the servers whose weight changed, as
+	// url=weight
+	ServersReweighted map[string][]string `json:"serversReweighted,omitempty"`
+}
+
+func diffConfigs(old, new Config) ConfigDiff {
+	var d ConfigDiff
+	for _, host := range sortedKeys(new.Http.Routers) {
+		o, ok := old.Http.Routers[host]
+		if !ok {
+			d.RoutersAdded = append(d.RoutersAdded, host)
+		} else if !reflect.DeepEqual(o, new.Http.Routers[host]) {
+			d.RoutersChanged = append(d.RoutersChanged, host)
+		}
+	}
+	for _, host := range sortedKeys(old.Http.Routers) {
+		if _, ok := new.Http.Routers[host]; !ok {
+			d.RoutersRemoved = append(d.RoutersRemoved, host)
+		}
+	}
+	for _, id := range sortedKeys(new.Http.Services) {
+		o, ok := old.Http.Services[id]
+		if !ok {
+			d.ServicesAdded = append(d.ServicesAdded, id)
+			continue
+		}
+		n := new.Http.Services[id]
+		added, removed, reweighted := diffServers(o.Servers, n.Servers)
+		if o.Servers, n.Servers = nil, nil; !reflect.DeepEqual(o, n) {
+			d.ServicesChanged = append(d.ServicesChanged, id)
+		}
+		addServers(&d.ServersAdded, id, added)
+		addServers(&d.ServersRemoved, id, removed)
+		addServers(&d.ServersReweighted, id, reweighted)
+	}
+	for _, id := range sortedKeys(old.Http.Services) {
+		if _, ok := new.Http.Services[id]; !ok {
+			d.ServicesRemoved = append(d.ServicesRemoved, id)
+		}
+	}
+	return d
+}
+
+// diffServers compares servers by URL, and the weights of those in both.
+func diffServers(old, new []Servers) (added, removed, reweighted []string) {
+	weights := make(map[string]int, len(old))
+	for _, s := range old {
+		weights[s.URL] = s.weight()
+	}
+	for _, s := range new {
+		if w, ok := weights[s.URL]; !ok {
+			added = append(added, s.URL)
+		} else if w != s.weight() {
+			reweighted = append(reweighted, fmt.Sprintf("%s=%d", s.URL, s.weight()))
+		}
+	}
+	for _, s := range old {
+		if !slices.ContainsFunc(new, func(n Servers) bool { return n.URL == s.URL }) {
+			removed = append(removed, s.URL)
+		}
+	}
+	return added, removed, reweighted
+}
+
+// addServers adds the servers of service to m, if there are any.
+func addServers(m *map[string][]string, service string, servers []string) {
+	if len(servers) == 0 {
+		return
+	}
+	if *m == nil {
+		*m = map[string][]string{}
+	}
+	(*m)[service] = servers
+}
+
+// HistoryEntry is a config that was applied.
+type HistoryEntry struct {
+	Version   string     `json:"version"`
+	AppliedAt time.Time  `json:"appliedAt"`
+	Routers   int        `json:"routers"`
+	Services  int        `json:"services"`
+	Diff      ConfigDiff `json:"diff"`
+
+	routes *RouteTable
+}
+
+// configHistory keeps the last few applied configs, most recent last, so
+// that changes can be traced and rolled back.
+type configHistory struct {
+	mutex   sync.Mutex
+	size    int
+	entries []HistoryEntry
+	logger  *slog.Logger
+}
+
+func newConfigHistory(size int, logger *slog.Logger) *configHistory {
+	return &configHistory{size: size, logger: logger}
+}
+
+// record adds routes to the history and logs how it differs from the
+// previous config.
+func (h *configHistory) record(routes *RouteTable) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var previous Config
+	previousVersion := ""
+	if n := len(h.entries); n > 0 {
+		if h.entries[n-1].Version == routes.Version() {
+			return
+		}
+		previous = h.entries[n-1].routes.Config()
+		previousVersion = h.entries[n-1].Version
+	}
+	e := HistoryEntry{
+		Version:   routes.Version(),
+		AppliedAt: time.Now(),
+		Routers:   len(routes.Config().Http.Routers),
+		Services:  len(routes.Config().Http.Services),
+		Diff:      diffConfigs(previous, routes.Config()),
+		routes:    routes,
+	}
+	h.logger.Info("config applied", "version", e.Version, "previous", previousVersion, "diff", e.Diff)
+
+	h.entries = append(h.entries, e)
+	if len(h.entries) > h.size {
+		h.entries = slices.Delete(h.entries, 0, len(h.entries)-h.size)
+	}
+}
+
+func (h *configHistory) Entries() []HistoryEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return slices.Clone(h.entries)
+}
+
+func (h *configHistory) find(version string) (*RouteTable, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, e := range h.entries {
+		if e.Version == version {
+			return e.routes, nil
+		}
+	}
+	return nil, fmt.Errorf("version %s is not in the history", version)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	zero, two := 0, 2
+	old := Config{Http: Http{
+		Routers: map[string]Routers{
+			"a.flakery.xyz": {Service: "a"},
+			"b.flakery.xyz": {Service: "b"},
+		},
+		Services: map[string]Services{
+			"a": {Servers: []Servers{{URL: "http://a1"}, {URL: "http://a2"}}},
+			"b": {Servers: []Servers{{URL: "http://b1", Weight: &two}, {URL: "http://b2", Weight: &two}}},
+		},
+	}}
+	for _, tt := range []struct {
+		name   string
+		change func(c *Config)
+		want   ConfigDiff
+	}{
+		{"unchanged", func(c *Config) {}, ConfigDiff{}},
+		{"router added and removed", func(c *Config) {
+			delete(c.Http.Routers, "b.flakery.xyz")
+			c.Http.Routers["c.flakery.xyz"] = Routers{Service: "b"}
+		}, ConfigDiff{RoutersAdded: []string{"c.flakery.xyz"}, RoutersRemoved: []string{"b.flakery.xyz"}}},
+		{"router changed", func(c *Config) {
+			c.Http.Routers["a.flakery.xyz"] = Routers{Service: "b"}
+		}, ConfigDiff{RoutersChanged: []string{"a.flakery.xyz"}}},
+		{"servers replaced", func(c *Config) {
+			c.Http.Services["a"] = Services{Servers: []Servers{{URL: "http://a2"}, {URL: "http://a3"}}}
+		}, ConfigDiff{
+			ServersAdded:   map[string][]string{"a": {"http://a3"}},
+			ServersRemoved: map[string][]string{"a": {"http://a1"}},
+		}},
+		{"servers reweighted", func(c *Config) {
+			// Equal weights in new pointers are unchanged
+			alsoTwo := 2
+			c.Http.Services["b"] = Services{Servers: []Servers{{URL: "http://b1", Weight: &zero}, {URL: "http://b2", Weight: &alsoTwo}}}
+		}, ConfigDiff{ServersReweighted: map[string][]string{"b": {"http://b1=0"}}}},
+		{"service changed", func(c *Config) {
+			c.Http.Services["b"] = Services{Servers: c.Http.Services["b"].Servers, Balancer: balancerP2C}
+		}, ConfigDiff{ServicesChanged: []string{"b"}}},
+		{"service added and removed", func(c *Config) {
+			c.Http.Services["c"] = c.Http.Services["b"]
+			delete(c.Http.Services, "b")
+		}, ConfigDiff{ServicesAdded: []string{"c"}, ServicesRemoved: []string{"b"}}},
+	} {
+		new := Config{Http: Http{Routers: map[string]Routers{}, Services: map[string]Services{}}}
+		for k, v := range old.Http.Routers {
+			new.Http.Routers[k] = v
+		}
+		for k, v := range old.Http.Services {
+			new.Http.Services[k] = v
+		}
+		tt.change(&new)
+		if got := diffConfigs(old, new); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// swappableProvider serves whichever table was last set.
+type swappableProvider struct{ routes *RouteTable }
+
+func (p *swappableProvider) Name() string                 { return "test" }
+func (p *swappableProvider) Routes() (*RouteTable, error) { return p.routes, nil }
+
+func TestHistoryPinAndUnpin(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	v1, err := compileConfig([]byte(polledConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := compileConfig([]byte(streamedConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &swappableProvider{v1}
+	states := newServerStates()
+	providers := NewProviders(logger, states, source)
+	admin := adminHandler(NewTTLCache("", time.Second, logger), providers, NewOutlierDetector(OutlierConfig{}, logger), states.breakers)
+	post := func(path string) int {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		return w.Code
+	}
+	current := func() string {
+		routes, err := providers.Routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return routes.Version()
+	}
+
+	first := current()
+	providers.Routes()
+	source.routes = v2
+	second := current()
+	entries := providers.history.Entries()
+	if len(entries) != 2 || entries[0].Version != first || entries[1].Version != second {
+		t.Fatalf("history %+v, want %s then %s", entries, first, second)
+	}
+	if want := map[string][]string{"a": {"http://streamed:8080"}}; !reflect.DeepEqual(entries[1].Diff.ServersAdded, want) {
+		t.Errorf("diff %+v", entries[1].Diff)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		version      string
+	}{
+		{"GET", "/config/pin?version=" + first, http.StatusMethodNotAllowed, second},
+		{"POST", "/config/pin?version=000000000000", http.StatusNotFound, second},
+		{"POST", "/config/pin?version=" + first, http.StatusOK, first},
+		{"GET", "/config/unpin", http.StatusMethodNotAllowed, first},
+		{"POST", "/config/unpin", http.StatusOK, second},
+	} {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status || current() != tt.version {
+			t.Errorf("%s %s: %d serving %s, want %d serving %s", tt.method, tt.path, w.Code, current(), tt.status, tt.version)
+		}
+	}
+
+	// While pinned, new configs still go into the history
+	if post("/config/pin?version="+first) != http.StatusOK {
+		t.Fatal("pin failed")
+	}
+	source.routes = v1
+	providers.Routes()
+	source.routes = v2
+	if current() != first || len(providers.history.Entries()) != 4 || providers.Pinned() != first {
+		t.Errorf("pinned config %s with %d history entries", current(), len(providers.history.Entries()))
+	}
+}
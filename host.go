@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// normalizeHost returns the canonical form of a host, which is how
+// routers are matched: lower case, without a default port or a trailing
+// dot, and with international labels mapped and converted to punycode as
+// for a DNS lookup. Labels that are host pattern wildcards are left alone.
+func normalizeHost(host string) string {
+	if isCanonicalHost(host) {
+		return host
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil && (port == "443" || port == "80") {
+		host = h
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	host = strings.TrimSuffix(host, ".")
+	labels := splitLabels(host)
+	for i, label := range labels {
+		if isHostPattern(label) {
+			continue
+		}
+		if isASCII(label) {
+			labels[i] = strings.ToLower(label)
+		} else if ascii, err := idna.Lookup.ToASCII(label); err == nil {
+			labels[i] = ascii
+		} else {
+			// Leave a label that isn't a valid IDN as it is, so that
+			// it matches nothing else
+			labels[i] = strings.ToLower(label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// isCanonicalHost is a quick check for the common case of a host that
+// normalizeHost would leave unchanged.
+func isCanonicalHost(host string) bool {
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c >= 0x80 || ('A' <= c && c <= 'Z') || c == ':' {
+			return false
+		}
+	}
+	return !strings.HasSuffix(host, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"foo.flakery.xyz", "foo.flakery.xyz"},
+		{"Foo.Flakery.XYZ", "foo.flakery.xyz"},
+		{"foo.flakery.xyz.", "foo.flakery.xyz"},
+		{"foo.flakery.xyz:443", "foo.flakery.xyz"},
+		{"FOO.flakery.xyz.:80", "foo.flakery.xyz"},
+		{"foo.flakery.xyz:8443", "foo.flakery.xyz:8443"},
+		{"[::1]:443", "[::1]"},
+		{"bücher.flakery.xyz", "xn--bcher-kva.flakery.xyz"},
+		{"MÜNCHEN.de", "xn--mnchen-3ya.de"},
+		{"例え.jp", "xn--r8jz45g.jp"},
+		{"ｆｏｏ.flakery.xyz", "foo.flakery.xyz"},
+		{"Straße.de", "xn--strae-oqa.de"},
+		{"{Name}.Preview.flakery.xyz", "{Name}.preview.flakery.xyz"},
+	}
+	for _, tt := range tests {
+		if got := normalizeHost(tt.host); got != tt.want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// HTTPListenerConfig configures the optional plain HTTP listener, which
+// redirects to HTTPS except for routers that allow HTTP.
+type HTTPListenerConfig struct {
+	// Listen is the address to listen on, or empty for no listener.
+	Listen string `json:"listen"`
+	// ACME HTTP-01 challenges are served from the files in
+	// ACMEChallengeDir, or else forwarded to ACMEChallengeURL, or else
+	// routed like any other request.
+	ACMEChallengeDir string `json:"acmeChallengeDir"`
+	ACMEChallengeURL string `json:"acmeChallengeURL"`
+}
+
+// httpHandler handles requests on the plain HTTP listener. Requests for
+// routers with AllowHTTP are passed to next, and the rest are redirected
+// to the same URL on the HTTPS listener at httpsListen.
+func httpHandler(config HTTPListenerConfig, httpsListen string, routeSource *Providers, next http.Handler) (http.Handler, error) {
+	var acme http.Handler
+	switch {
+	case config.ACMEChallengeDir != "":
+		acme = http.StripPrefix(acmeChallengePath, http.FileServer(http.Dir(config.ACMEChallengeDir)))
+	case config.ACMEChallengeURL != "":
+		target, err := url.Parse(config.ACMEChallengeURL)
+		if err != nil {
+			return nil, fmt.Errorf("ACME challenge URL: %w", err)
+		}
+		acme = httputil.NewSingleHostReverseProxy(target)
+	}
+
+	httpsPort := ""
+	if _, port, err := net.SplitHostPort(httpsListen); err == nil && port != "443" {
+		httpsPort = ":" + port
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acme != nil && strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			acme.ServeHTTP(w, r)
+			return
+		}
+		host := normalizeHost(r.Host)
+		if routes, err := routeSource.Routes(); err == nil {
+			if match, ok := routes.Lookup(host, r); ok && match.AllowHTTP {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		// 301 is cached more widely but lets clients change the method
+		// of other requests to GET
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+httpsPort+r.URL.RequestURI(), status)
+	}), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	static, err := newStaticProvider("test", Config{Http: Http{
+		Routers: map[string]Routers{
+			"a.flakery.xyz": {Service: "a"},
+			"plain":         {Rule: "Host(`b.flakery.xyz`)", Service: "a", AllowHTTP: true},
+		},
+		Services: map[string]Services{"a": {Servers: []Servers{{URL: "http://a:80"}}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := NewProviders(slog.New(slog.NewTextHandler(io.Discard, nil)), newServerStates(), static)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte("key-authz"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "proxied")
+	})
+	h, err := httpHandler(HTTPListenerConfig{ACMEChallengeDir: dir}, ":8443", providers, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, host, target string
+		status               int
+		want                 string
+	}{
+		{"GET", "a.flakery.xyz", "/x?y=z", 301, "https://a.flakery.xyz:8443/x?y=z"},
+		{"POST", "A.flakery.xyz:80", "/x", 308, "https://a.flakery.xyz:8443/x"},
+		{"GET", "unknown.flakery.xyz", "/", 301, "https://unknown.flakery.xyz:8443/"},
+		{"GET", "b.flakery.xyz", "/", 200, "proxied"},
+		{"GET", "a.flakery.xyz", "/.well-known/acme-challenge/token", 200, "key-authz"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		got := w.Body.String()
+		if w.Code/100 == 3 {
+			got = w.Header().Get("Location")
+		}
+		if w.Code != tt.status || got != tt.want {
+			t.Errorf("%s %s%s: %d %q, want %d %q", tt.method, tt.host, tt.target, w.Code, got, tt.status, tt.want)
+		}
+	}
+}
@@ -2,37 +2,121 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/tls"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"log/slog"
-	"math/big"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/pkg/errors"
 )
 
+// Routers are keyed by name. A router without a rule matches requests for
+// the host it is named after, which may be a pattern such as
+// *.flakery.xyz. Headers are set on the requests it forwards, with
+// {name} replaced by the host label captured by {name} in the rule.
+// Plain HTTP requests are redirected to HTTPS unless AllowHTTP is set.
 type Routers struct {
-	Service string `json:"service"`
+	Service   string            `json:"service"`
+	Rule      string            `json:"rule,omitempty"`
+	Priority  int               `json:"priority,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	AllowHTTP bool              `json:"allowHTTP,omitempty"`
+	Pin       *Pin              `json:"pin,omitempty"`
+	Mirror    *Mirror           `json:"mirror,omitempty"`
 }
 
+// Mirror sends a copy of Percent of a router's requests to Service in the
+// background, discarding the responses. Requests with bodies larger than
+// MaxBodySize (by default 64KiB) aren't copied.
+type Mirror struct {
+	Service     string  `json:"service"`
+	Percent     float64 `json:"percent"`
+	MaxBodySize int64   `json:"maxBodySize,omitempty"`
+}
+
+// Pin lets a request choose one of Services instead of the router's
+// service by naming it in Header or Cookie, for example to try out a
+// preview deployment. Other service names are ignored, so that clients
+// can only reach the services listed.
+type Pin struct {
+	Header   string   `json:"header,omitempty"`
+	Cookie   string   `json:"cookie,omitempty"`
+	Services []string `json:"services"`
+}
+
+func (r Routers) ruleText(name string) string {
+	if r.Rule == "" {
+		return "Host(`" + name + "`)"
+	}
+	return r.Rule
+}
+
+// Servers get a share of their service's requests in proportion to
+// Weight, which defaults to 1. A server with a weight of 0 gets none, so
+// that it can be drained without being removed.
 type Servers struct {
-	URL string `json:"url"`
+	URL    string `json:"url"`
+	Weight *int   `json:"weight,omitempty"`
 }
 
+func (s Servers) weight() int {
+	if s.Weight == nil {
+		return 1
+	}
+	return *s.Weight
+}
+
+// Services forward to their servers, unless they have a built-in Type
+// (see builtin.go) answered by the proxy itself using the other fields,
+// or are Weighted and split requests between other services. Balancer
+// names the algorithm that picks a server for each request (see
+// balancer.go), unless Sticky keeps a client on the same server.
+// CircuitBreaker stops sending requests to failing or slow servers (see
+// circuitbreaker.go).
 type Services struct {
-	Servers []Servers `json:"servers"`
+	Servers        []Servers        `json:"servers"`
+	Weighted       *WeightedService `json:"weighted,omitempty"`
+	Balancer       string           `json:"balancer,omitempty"`
+	Sticky         *Sticky          `json:"sticky,omitempty"`
+	CircuitBreaker *CircuitBreaker  `json:"circuitBreaker,omitempty"`
+	Type           string           `json:"type,omitempty"`
+	Status         int              `json:"status,omitempty"`
+	Body           string           `json:"body,omitempty"`
+	ContentType    string           `json:"contentType,omitempty"`
+	URL            string           `json:"url,omitempty"`
+}
+
+// Sticky sends a client's requests to the same server of a service while
+// it stays healthy. With Cookie, the balancer's first pick is remembered
+// in a signed cookie of that name. With Hash, the server is chosen by
+// consistent hashing of "ip" (the client's address), "header:<name>", or
+// "jwt" or "jwt:<header>" (the user ID in a JWT, by default in the
+// Authorization header), so that few clients move when servers change.
+type Sticky struct {
+	Cookie string `json:"cookie,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+// WeightedService splits requests between services in proportion to
+// their weights, for example to send 5% of traffic to a canary.
+type WeightedService struct {
+	Services []WeightedRef `json:"services"`
+}
+
+type WeightedRef struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
 }
 
 type Http struct {
@@ -45,6 +129,9 @@ type Config struct {
 }
 
 func parseConfig(config []byte) (Config, error) {
+	if err := checkDuplicateKeys(config); err != nil {
+		return Config{}, err
+	}
 	var c Config
 	err := json.Unmarshal(config, &c)
 	if err != nil {
@@ -79,39 +166,78 @@ body {
 </body>
 </html>`
 
-var unhealthyHosts = map[Servers]bool{}
-
+// ConnectionErrorHandler forwards a request to server through its
+// circuit breaker, if any, records how long the response took and
+// whether it failed, and reports it to outliers. The request holds its
+// place in the circuit until release is called.
 type ConnectionErrorHandler struct {
 	http.RoundTripper
 	slog.Logger
-	server Servers
+	server   Servers
+	outliers *OutlierDetector
+	breaker  *breaker
+	circuit  *CircuitBreaker
+	latency  time.Duration
+	err      error
+	// acquired is set while the request holds a place in the circuit
+	acquired, probe, failed bool
 }
 
 func (c *ConnectionErrorHandler) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.breaker != nil {
+		if c.probe, c.acquired = c.breaker.acquire(c.circuit, time.Now()); !c.acquired {
+			c.err = errCircuitOpen
+			return unavailableResponse(max(c.breaker.retryAfter(time.Now()), time.Second)), nil
+		}
+	}
+	start := time.Now()
 	resp, err := c.RoundTripper.RoundTrip(req)
+	c.latency, c.err = time.Since(start), err
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	c.failed = failedRequest(req, status, err)
+	c.outliers.record(c.server.URL, c.failed)
 	if err != nil {
-		c.Error("backend request failed", "err", err, "remoteAddr", req.RemoteAddr, "url", req.URL.String(), "host", req.Host)
-		c.Info("marking server as unhealthy", "server", c.server)
-		// mark server as unhealthy
-		unhealthyHosts[c.server] = true
+		c.Error("backend request failed", "err", err, "remoteAddr", req.RemoteAddr, "url", req.URL.String(), "host", req.Host, "server", c.server.URL)
 	}
 	if _, ok := err.(*net.OpError); ok {
 		c.Error("backend connection failed", "err", err, "remoteAddr", req.RemoteAddr, "url", req.URL.String(), "host", req.Host)
-		r := &http.Response{
-			StatusCode: http.StatusServiceUnavailable,
-			Body:       ioutil.NopCloser(bytes.NewBufferString(message)),
-		}
-		return r, nil
+		return unavailableResponse(0), nil
 	}
 	return resp, err
 }
 
-func healthyServers(s []Servers, unhealthyHosts map[Servers]bool) []Servers {
-	return s // noop
-	// return lo.Filter(s, func(s Servers, _ int) bool {
-	// 	_, ok := unhealthyHosts[s]
-	// 	return !ok
-	// })
+// release gives up the request's place in the circuit, once its
+// response has been passed on.
+func (c *ConnectionErrorHandler) release() {
+	if !c.acquired {
+		return
+	}
+	c.acquired = false
+	if c.breaker.release(c.circuit, c.probe, c.latency, c.failed, time.Now()) {
+		c.Warn("circuit opened", "server", c.server.URL, "for", time.Duration(c.circuit.OpenFor).String())
+	}
+}
+
+// unavailableResponse is the 503 page given for a server that can't be
+// reached, with a Retry-After header if retryAfter is positive.
+func unavailableResponse(retryAfter time.Duration) *http.Response {
+	r := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(message)),
+	}
+	if retryAfter > 0 {
+		r.Header.Set("Retry-After", retryAfterSeconds(retryAfter))
+	}
+	return r
+}
+
+// retryAfterSeconds formats d for a Retry-After header, rounding up.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
 }
 
 type MyCustomClaims struct {
@@ -119,22 +245,20 @@ type MyCustomClaims struct {
 	jwt.RegisteredClaims
 }
 
-func getServersFromHost(
+func matchRequest(
 	host string,
-	routers map[string]Routers,
-	services map[string]Services,
+	routes *RouteTable,
+	hosts SpecialHosts,
 	logger *slog.Logger,
 	r *http.Request,
-) ([]Servers, error) {
+) (*Match, error) {
 
-	var service Services
-	if host == "wp.flakery.xyz" {
+	if host == hosts.PrivateCache {
 		// check for host header X-Flakery-User-key
 		logger.Info("checking for user key")
 		userKey := r.Header.Get("X-Flakery-User-Key")
 		if userKey == "" {
-			// http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return nil, fmt.Errorf("unauthorized")
+			return nil, unauthorized("missing X-Flakery-User-Key", nil)
 		}
 		logger.Info("user key", "key", userKey)
 		// todo get user id from key
@@ -146,7 +270,7 @@ func getServersFromHost(
 
 		claims, err := parseJwt(userKey, secret)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, unauthorized("invalid X-Flakery-User-Key", err)
 		}
 		logger.Info("claims", "claims", claims)
 
@@ -160,7 +284,7 @@ func getServersFromHost(
 			return nil, fmt.Errorf("FLAKERY_API_KEY not set")
 		}
 
-		url := fmt.Sprintf("https://flakery.dev/api/v0/user/private-binary-cache/%s", userID)
+		url := hosts.PrivateCacheAPI + userID
 		req, err := http.NewRequest("GET", url, nil)
 		if err != nil {
 			return nil, fmt.Errorf("error creating request")
@@ -171,36 +295,39 @@ func getServersFromHost(
 		client := &http.Client{}
 		resp, err := client.Do(req)
 		if err != nil {
-			return nil, fmt.Errorf("error making request")
+			return nil, badGateway("error looking up private cache", err)
 		}
 		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+			return nil, forbidden("no private cache for this user", fmt.Errorf("lookup returned %s", resp.Status))
+		case resp.StatusCode != http.StatusOK:
+			return nil, badGateway("error looking up private cache", fmt.Errorf("lookup returned %s", resp.Status))
+		}
 
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return nil, fmt.Errorf("error reading body")
+			return nil, badGateway("error looking up private cache", err)
 		}
 
 		var cache PrivateBinaryCache
 		err = json.Unmarshal(body, &cache)
 		if err != nil {
-			return nil, fmt.Errorf("error unmarshalling body")
+			return nil, badGateway("error looking up private cache", err)
 		}
 		logger.Info("cache", "cache", cache)
 
-		service = services[cache.DeploymentID]
-
-	} else {
-		router, ok := routers[host]
-		if !ok {
-			return nil, fmt.Errorf("router not found")
-		}
-		service, ok = services[router.Service]
+		service, ok := routes.Service(cache.DeploymentID)
 		if !ok {
-			return nil, fmt.Errorf("service not found")
+			return nil, unavailable("private cache is not running", fmt.Errorf("deployment %s is not routed", cache.DeploymentID))
 		}
+		return &Match{Service: service}, nil
 	}
-	return service.Servers, nil
-
+	match, ok := routes.Lookup(host, r)
+	if !ok {
+		return nil, errNoRouter
+	}
+	return match, nil
 }
 
 func parseJwt(tokenString string, secret string) (interface{}, error) {
@@ -220,152 +347,219 @@ func parseJwt(tokenString string, secret string) (interface{}, error) {
 
 }
 
-type PrivateBinaryCache struct {
-	DeploymentID string `json:"deploymentID"`
-}
-
-func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
-	logger.Info("starting", "version", Version)
-
-	var (
-		listen, cert, key, where                            string
-		useTLS, useLogging, behindTCPProxy, onlyHealthcheck bool
-		flushInterval                                       time.Duration
-	)
-	flag.StringVar(&listen, "listen", ":443", "Bind address to listen on")
-	// certFile = "/var/lib/acme/flakery.xyz/cert.pem";
-	// keyFile = "";
-	flag.StringVar(&key, "key", "/var/lib/acme/flakery.xyz/key.pem", "Path to PEM key")
-	flag.StringVar(&cert, "cert", "/var/lib/acme/flakery.xyz/cert.pem", "Path to PEM certificate")
-	flag.StringVar(&where, "where", "http://10.0.4.20:3000", "Place to forward connections to")
-	flag.BoolVar(&useTLS, "tls", true, "accept HTTPS connections")
-	flag.BoolVar(&useLogging, "logging", true, "log requests")
-	flag.BoolVar(&behindTCPProxy, "behind-tcp-proxy", false, "running behind TCP proxy (such as ELB or HAProxy)")
-	flag.DurationVar(&flushInterval, "flush-interval", 0, "minimum duration between flushes to the client (default: off)")
-	flag.BoolVar(&onlyHealthcheck, "only-healthcheck", false, "only run healthcheck")
-	oldUsage := flag.Usage
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "\n%v version %v\n\n", os.Args[0], Version)
-		oldUsage()
-	}
-	flag.Parse()
-
-	var handler http.Handler
-
-	ttlCache := NewTTLCache(5 * time.Second)
-	if onlyHealthcheck {
-		healthCheck(ttlCache)
-		return
-	} else {
-		// todo dangling go routine
-		go healthCheck(ttlCache)
+// proxyHandler routes requests with the routes from routeSource and
+// forwards them to their services' servers. Requests for hosts that no
+// router matches are forwarded to config.Where with config.CatchAll.
+func proxyHandler(config ProxyConfig, routeSource *Providers, ttlCache *TTLCache, outliers *OutlierDetector, logger *slog.Logger) (http.Handler, error) {
+	catchAll, err := newService("catch-all", Services{Servers: []Servers{{URL: config.Where}}}, nil)
+	if err != nil {
+		return nil, err
 	}
-	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/_version" {
-			w.Header().Add("X-Tiny-SSL-Version", Version)
-		}
-		if r.Host == "loadb.flakery.xyz" {
-			// print 🌨️
-			fmt.Fprintf(w, "🌨️\n")
-			logger.Info("🌨️")
-			return
+			w.Header().Set("X-Tiny-SSL-Version", Version)
 		}
-		r.Header.Set("X-Forwarded-Proto", "https")
-
-		// if host is www.flakery.xyz, serve localhost:3000
-		if r.Host == "www.flakery.dev" {
-			// reverse proxy to localhost:3000
-			logger.Info("proxying to localhost:3000")
-			proxy := httputil.NewSingleHostReverseProxy(&url.URL{
-				Scheme: "http",
-				Host:   "localhost:3000",
-			})
-			proxy.ServeHTTP(w, r)
-			return
+		host := normalizeHost(r.Host)
+		if r.TLS != nil {
+			r.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			r.Header.Set("X-Forwarded-Proto", "http")
 		}
 
-		// print request url
-		c, err := ttlCache.Get()
+		routes, err := routeSource.Routes()
 		if err != nil {
-			logger.Error("error getting ttl cache", "err", err)
-			http.Error(w, "Error", http.StatusInternalServerError)
-			return
-		}
-		// fmt.Fprintf(w, "Cache: %s\n", c)
-		config, err := parseConfig(c)
-		if err != nil {
-			logger.Error("error parsing config", "err", err)
-			http.Error(w, "Error", http.StatusInternalServerError)
+			writeRouteError(w, r, logger, badGateway("routing config unavailable", err))
 			return
 		}
 
 		fmt.Println("Host: ", r.Host)
-		logger.Info("request", "host", r.Host, "url", r.URL.String())
+		logger.Info("request", "host", r.Host, "url", r.URL.String(), "configVersion", routes.Version())
 
-		// servers := config.Http.Services[router.Service].Servers
-		servers, err := getServersFromHost(r.Host, config.Http.Routers, config.Http.Services, logger, r)
+		match, err := matchRequest(host, routes, config.Hosts, logger, r)
 
-		if err != nil {
-			logger.Error("error getting servers", "err", err)
-			http.Error(w, "Error", http.StatusInternalServerError)
+		if err == errNoRouter {
+			if unloaded := routeSource.Unloaded(); unloaded != nil {
+				// The request may be for a provider that hasn't loaded
+				err = badGateway("routing config unavailable", unloaded)
+			}
+		}
+		var service *Service
+		switch {
+		case err == errNoRouter && config.CatchAll:
+			service = catchAll
+		case err != nil:
+			writeRouteError(w, r, logger, err)
 			return
+		default:
+			if match.Pinned {
+				logger.Info("pinned request", "router", match.Router, "service", match.Service.ID)
+			}
+			service = match.Service.pick()
+			match.SetHeaders(r.Header)
+			mirrorRequest(match.mirror, r, logger)
+			if service.builtin != nil {
+				service.builtin(w, r, proxyInfo{routes, ttlCache.Status().AgeSeconds})
+				return
+			}
 		}
 
-		// filter unhealthy servers
-		if len(servers) > 1 { // temporary hack to avoid empty server list
-			servers = healthyServers(servers, unhealthyHosts)
+		ejected := outliers.excluder(service.Backends)
+		exclude := func(i int) bool {
+			return !service.circuitAllows(i) || ejected(i)
 		}
-		// pick random server
-		num := len(servers)
-		if num == 0 {
-			logger.Error("no servers found", "service", r.Host)
-			http.Error(w, "No servers found", http.StatusServiceUnavailable)
-			return
+		var cookie *http.Cookie
+		i := outliers.pick(service, exclude, func(exclude func(i int) bool) int {
+			var i int
+			i, cookie = service.pickBackend(r, exclude)
+			return i
+		})
+		if i < 0 {
+			// With every server ejected, trying one beats failing, but
+			// open circuits stay open
+			i, cookie = service.pickBackend(r, func(i int) bool {
+				return !service.circuitAllows(i)
+			})
 		}
-		rnum, err := rand.Int(
-			rand.Reader,
-			big.NewInt(int64(num)),
-		)
-		if err != nil {
-			logger.Error("error getting random number", "err", err)
-			http.Error(w, "Error", http.StatusInternalServerError)
+		if i < 0 {
+			if wait := service.circuitRetryAfter(); wait > 0 {
+				w.Header().Set("Retry-After", retryAfterSeconds(wait))
+			}
+			writeRouteError(w, r, logger, unavailable("no servers available", nil))
 			return
 		}
-		serverIndex := rnum.Int64()
-		serv := servers[serverIndex]
-		server := servers[serverIndex].URL
-		parsed, err := url.Parse(server)
-		if err != nil {
-			logger.Error("error parsing server", "err", err)
+		if cookie != nil {
+			http.SetCookie(w, cookie)
 		}
-		h := httputil.NewSingleHostReverseProxy(parsed)
-		h.Transport = &ConnectionErrorHandler{
-			http.DefaultTransport,
-			*logger,
-			serv,
+		transport := &backendTransport{
+			config:   config.Retries,
+			budget:   service.budget,
+			service:  service,
+			backend:  i,
+			exclude:  exclude,
+			outliers: outliers,
+			logger:   logger,
+			inbound:  r.URL,
 		}
-		h.FlushInterval = flushInterval
-
+		if config.Retries.Attempts > 0 {
+			transport.body = captureBody(r, config.Retries.MaxBodySize)
+		}
+		h := httputil.NewSingleHostReverseProxy(service.Backends[i].Target)
+		h.Transport = transport
+		h.FlushInterval = time.Duration(config.FlushInterval)
+
+		// ReverseProxy panics to abort the response if the client goes
+		// away, so make sure the pick is always accounted for
+		defer func() {
+			if !transport.attempted {
+				service.balancer.Done(i, 0, nil)
+			}
+		}()
 		h.ServeHTTP(w, r)
-	})
+	}), nil
+}
+
+type PrivateBinaryCache struct {
+	DeploymentID string `json:"deploymentID"`
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		checkConfigMain(os.Args[2:])
+		return
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	logger.Info("starting", "version", Version)
 
-	keyCerts := [][]string{
-		{"/var/lib/acme/flakery.xyz/key.pem", "/var/lib/acme/flakery.xyz/cert.pem"},
-		{"/var/lib/acme/flakery.dev/key.pem", "/var/lib/acme/flakery.dev/cert.pem"},
+	config, flags, err := parseProxyConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Providers in order of precedence
+	var providers []Provider
+	if flags.routes.routes != nil {
+		providers = append(providers, &flags.routes)
+	}
+	if config.ConfigFile != "" {
+		fileProvider, err := NewFileProvider(config.ConfigFile, logger)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go fileProvider.Run(context.Background())
+		providers = append(providers, fileProvider)
+	}
+	controlPlane := config.ControlPlane
+	ttlCache := NewTTLCache(controlPlane.ConfigURL(), time.Duration(controlPlane.TTL), logger)
+	if controlPlane.Enabled {
+		if config.StateFile != "" {
+			if err := ttlCache.UseStateFile(config.StateFile, time.Duration(config.StateMaxAge)); err != nil {
+				logger.Warn("not using persisted config", "err", err, "path", config.StateFile)
+			} else {
+				logger.Info("loaded persisted config", "path", config.StateFile, "fetchedAt", ttlCache.Status().FetchedAt)
+			}
+		}
+		if controlPlane.Stream {
+			go NewConfigStream(controlPlane.StreamURL(), ttlCache, logger).Run(context.Background())
+		}
+		// Fetch the config before the first request asks for it
+		ttlCache.revalidate()
+		providers = append(providers, ttlCache)
+
+		// Health checks report to the control plane, so only cover the
+		// deployments it knows about
+		if flags.onlyHealthcheck {
+			healthCheck(ttlCache, config.HealthCheck, controlPlane)
+			return
+		} else {
+			// todo dangling go routine
+			go healthCheck(ttlCache, config.HealthCheck, controlPlane)
+		}
+	}
+	if len(providers) == 0 {
+		log.Fatal("no routing config: enable -control-plane, or give -config-file or -route")
 	}
+	builtins, err := newBuiltinProvider(config.Routing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	providers = append(providers, builtins)
+	states := newServerStates()
+	routeSource := NewProviders(logger, states, providers...)
+	outliers := NewOutlierDetector(config.Outliers, logger)
+
+	if config.AdminListen != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(config.AdminListen, adminHandler(ttlCache, routeSource, outliers, states.breakers)))
+		}()
+	}
+	handler, err := proxyHandler(config, routeSource, ttlCache, outliers, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	cfg := &tls.Config{}
 
-	for _, keyCert := range keyCerts {
-		cert, err := tls.LoadX509KeyPair(keyCert[1], keyCert[0])
+	for _, keyCert := range config.TLSCertificates() {
+		cert, err := tls.LoadX509KeyPair(keyCert.Cert, keyCert.Key)
 		if err != nil {
 			log.Fatal(err)
 		}
 		cfg.Certificates = append(cfg.Certificates, cert)
 	}
 
+	if config.HTTPListener.Listen != "" {
+		h, err := httpHandler(config.HTTPListener, config.Listen, routeSource, handler)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(config.HTTPListener.Listen, h))
+		}()
+	}
+
 	server := http.Server{
-		Addr:      listen,
+		Addr:      config.Listen,
 		Handler:   handler,
 		TLSConfig: cfg,
 	}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxyHandlerUnroutedHosts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	where := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "where")
+	}))
+	defer where.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	static, err := newStaticProvider("flags", Config{Http: Http{
+		Routers:  map[string]Routers{"a.flakery.xyz": {Service: "a"}},
+		Services: map[string]Services{"a": {Servers: []Servers{{URL: backend.URL}}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	builtins, err := newBuiltinProvider(builtinConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(config ProxyConfig, providers ...Provider) func(host string) (int, string) {
+		providers = append(providers, builtins)
+		routeSource := NewProviders(logger, newServerStates(), providers...)
+		h, err := proxyHandler(config, routeSource, NewTTLCache("", time.Second, logger), NewOutlierDetector(OutlierConfig{}, logger), logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return func(host string) (int, string) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = host
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				return w.Code, ""
+			}
+			return w.Code, w.Body.String()
+		}
+	}
+	failing := &swappableProvider{}
+
+	for _, tt := range []struct {
+		name      string
+		catchAll  bool
+		providers []Provider
+		host      string
+		status    int
+		body      string
+	}{
+		{"routed host", false, []Provider{static}, "a.flakery.xyz", 200, "backend"},
+		{"unknown host", false, []Provider{static}, "b.flakery.xyz", 404, ""},
+		{"unknown host with -catch-all", true, []Provider{static}, "b.flakery.xyz", 200, "where"},
+		{"unknown host with a provider failing", false, []Provider{static, failing}, "b.flakery.xyz", 502, ""},
+		{"unknown host with a provider failing and -catch-all", true, []Provider{static, failing}, "b.flakery.xyz", 502, ""},
+		{"routed host with a provider failing", false, []Provider{static, failing}, "a.flakery.xyz", 200, "backend"},
+		{"every provider failing", true, []Provider{failing}, "a.flakery.xyz", 502, ""},
+	} {
+		status, body := serve(ProxyConfig{Where: where.URL, CatchAll: tt.catchAll}, tt.providers...)(tt.host)
+		if status != tt.status || body != tt.body {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, status, body, tt.status, tt.body)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultMirrorBodySize = 64 << 10
+	// maxMirrorRequests bounds the mirrored requests in flight, beyond
+	// which requests aren't mirrored.
+	maxMirrorRequests = 128
+	mirrorTimeout     = 30 * time.Second
+)
+
+var (
+	mirrorClient = &http.Client{
+		Timeout: mirrorTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	mirrorSlots = make(chan struct{}, maxMirrorRequests)
+)
+
+// mirror is a compiled Mirror.
+type mirror struct {
+	service     *Service
+	percent     float64
+	maxBodySize int64
+}
+
+// mirrorRequest sends a copy of r to m's service in the background if r
+// is sampled, discarding the response. It must be called before r is
+// forwarded. A request with a body is copied once the body has been read
+// in full as it is forwarded, so that r is never held up, and isn't
+// copied if the body turns out to be larger than m.maxBodySize. Nothing
+// that goes wrong with the copy affects r.
+func mirrorRequest(m *mirror, r *http.Request, logger *slog.Logger) {
+	if m == nil || rand.Float64()*100 >= m.percent || r.ContentLength > m.maxBodySize {
+		return
+	}
+	copied := r.Clone(context.Background())
+	copied.RequestURI = ""
+	copied.Header.Del("Connection")
+	send := func(body []byte) {
+		sendMirror(m.service.pick(), copied, body, logger)
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		send(nil)
+		return
+	}
+	r.Body = &teeBody{ReadCloser: r.Body, max: m.maxBodySize, done: send}
+}
+
+// sendMirror sends r with body to a server of service in the background.
+func sendMirror(service *Service, r *http.Request, body []byte, logger *slog.Logger) {
+	i := service.balancer.Pick(nil)
+	if i < 0 {
+		return
+	}
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		logger.Warn("not mirroring request, too many in flight", "host", r.Host, "service", service.ID)
+		service.balancer.Done(i, 0, nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	r = r.WithContext(ctx)
+	r.URL = backendURL(service.Backends[i].Target, r.URL)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	go func() {
+		defer func() { <-mirrorSlots }()
+		defer cancel()
+		start := time.Now()
+		resp, err := mirrorClient.Do(r)
+		service.balancer.Done(i, time.Since(start), err)
+		if err != nil {
+			logger.Warn("mirrored request failed", "host", r.Host, "service", service.ID, "err", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// teeBody is a request body that keeps what is read from it, up to max
+// bytes, and calls done with it once all of it has been read.
+type teeBody struct {
+	io.ReadCloser
+	max  int64
+	buf  []byte
+	done func(body []byte)
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done == nil {
+		return n, err
+	}
+	if int64(len(b.buf)+n) > b.max {
+		// Too large to copy
+		b.done, b.buf = nil, nil
+		return n, err
+	}
+	b.buf = append(b.buf, p[:n]...)
+	if err == io.EOF {
+		done := b.done
+		b.done = nil
+		done(b.buf)
+	}
+	return n, err
+}
+
+// backendURL returns the URL on target for a request received for u,
+// joined the same way as by httputil.NewSingleHostReverseProxy: escaped
+// paths are kept and target's query comes first.
+func backendURL(target, u *url.URL) *url.URL {
+	joined := *u
+	pr := httputil.ProxyRequest{Out: &http.Request{URL: &joined}}
+	pr.SetURL(target)
+	return pr.Out.URL
+}
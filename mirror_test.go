@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorRequest(t *testing.T) {
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.Host + r.URL.RequestURI() + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	service, err := newService("shadow", Services{Servers: []Servers{{URL: shadow.URL}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mirror{
+		service:     service,
+		percent:     100,
+		maxBodySize: 8,
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	r := httptest.NewRequest("POST", "/api?x=1", strings.NewReader("payload"))
+	r.Host = "app.flakery.xyz"
+	mirrorRequest(m, r, logger)
+	// The copy is sent once the body has been forwarded
+	if body, _ := io.ReadAll(r.Body); string(body) != "payload" {
+		t.Errorf("original body is now %q", body)
+	}
+	select {
+	case got := <-mirrored:
+		if want := "POST app.flakery.xyz/api?x=1 payload"; got != want {
+			t.Errorf("mirrored %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	// A streamed body isn't waited for
+	pr, pw := io.Pipe()
+	r = httptest.NewRequest("POST", "/stream", pr)
+	r.Host = "app.flakery.xyz"
+	r.ContentLength = -1
+	returned := make(chan struct{})
+	go func() {
+		mirrorRequest(m, r, logger)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirroring waited for a streamed body")
+	}
+	go func() {
+		io.WriteString(pw, "stream")
+		pw.Close()
+	}()
+	if body, _ := io.ReadAll(r.Body); string(body) != "stream" {
+		t.Errorf("original body is now %q", body)
+	}
+	select {
+	case got := <-mirrored:
+		if want := "POST app.flakery.xyz/stream stream"; got != want {
+			t.Errorf("mirrored %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("streamed request was not mirrored")
+	}
+
+	// Too large to mirror, with an unknown length
+	r = httptest.NewRequest("POST", "/api", io.NopCloser(strings.NewReader("a larger payload")))
+	r.ContentLength = -1
+	mirrorRequest(m, r, logger)
+	if body, _ := io.ReadAll(r.Body); string(body) != "a larger payload" {
+		t.Errorf("original body is now %q", body)
+	}
+	select {
+	case got := <-mirrored:
+		t.Errorf("mirrored %q, which is over the size limit", got)
+	default:
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// outlierProbeInterval is how long a probe of an ejected server may take
+// before another request is let through to probe it.
+const outlierProbeInterval = 10 * time.Second
+
+// OutlierConfig configures passive health checking, which ejects servers
+// whose requests fail from their services' balancing.
+type OutlierConfig struct {
+	// ConsecutiveFailures ejects a server after this many failed
+	// requests in a row (0 to disable).
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// ErrorRate ejects a server when this percentage of its requests in a
+	// Window fail, once it has had MinRequests (0 to disable).
+	ErrorRate   float64  `json:"errorRate"`
+	MinRequests int      `json:"minRequests"`
+	Window      Duration `json:"window"`
+	// A server is first ejected for BaseEjection, then for twice as long
+	// each time it is ejected again, up to MaxEjection.
+	BaseEjection Duration `json:"baseEjection"`
+	MaxEjection  Duration `json:"maxEjection"`
+}
+
+// OutlierDetector tracks the requests to each server, by URL so that it
+// outlives config changes. An ejected server is half open once its
+// ejection is over: one request at a time is let through to probe it,
+// and the server returns if the probe succeeds or is ejected for longer
+// if it fails.
+type OutlierDetector struct {
+	config    OutlierConfig
+	logger    *slog.Logger
+	mutex     sync.Mutex
+	servers   map[string]*serverHealth
+	expiredAt time.Time
+}
+
+type serverHealth struct {
+	consecutive int
+	// requests and failures in the window starting at windowStart
+	requests, failures int
+	windowStart        time.Time
+	// ejections counts the ejections since the server was last healthy
+	// for MaxEjection
+	ejections    int
+	ejected      bool
+	probing      bool
+	ejectedUntil time.Time
+	recoveredAt  time.Time
+	lastRequest  time.Time
+}
+
+func NewOutlierDetector(config OutlierConfig, logger *slog.Logger) *OutlierDetector {
+	return &OutlierDetector{config: config, logger: logger, servers: map[string]*serverHealth{}, expiredAt: time.Now()}
+}
+
+// expire forgets the servers that have been neither sent a request nor
+// ejected for longer than an ejection or a window lasts, such as those of
+// deployments that are gone. It sweeps at most once per
+// outlierProbeInterval, and must be called with d.mutex held.
+func (d *OutlierDetector) expire(now time.Time) {
+	if now.Sub(d.expiredAt) < outlierProbeInterval {
+		return
+	}
+	d.expiredAt = now
+	idle := max(time.Duration(d.config.MaxEjection), time.Duration(d.config.Window))
+	for server, h := range d.servers {
+		last := h.lastRequest
+		if h.ejectedUntil.After(last) {
+			last = h.ejectedUntil
+		}
+		if now.Sub(last) > idle {
+			delete(d.servers, server)
+		}
+	}
+}
+
+// failedRequest reports whether a request to a server that returned
+// status and err counts against the server.
+func failedRequest(r *http.Request, status int, err error) bool {
+	if err != nil {
+		// The client going away isn't the server's fault
+		return r.Context().Err() == nil
+	}
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// excluder returns a Balancer exclude function ruling out the ejected
+// backends, apart from those whose ejection is over and that are free to
+// be probed. It has no side effects; a request only takes the probe of
+// the backend it ends up with, through pick.
+func (d *OutlierDetector) excluder(backends []Backend) func(i int) bool {
+	return func(i int) bool {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		h := d.servers[backends[i].URL]
+		return h != nil && h.ejected && time.Now().Before(h.ejectedUntil)
+	}
+}
+
+// pick calls choose, which picks a backend of s that exclude doesn't rule
+// out, and claims the probe if the backend is half open. Should another
+// request have claimed that probe first, it picks again without the
+// backend. It returns -1 if there is no backend left.
+func (d *OutlierDetector) pick(s *Service, exclude func(i int) bool, choose func(exclude func(i int) bool) int) int {
+	lost := map[int]bool{}
+	for {
+		i := choose(func(j int) bool { return lost[j] || exclude(j) })
+		if i < 0 || d.claim(s.Backends[i].URL) {
+			return i
+		}
+		s.balancer.Done(i, 0, nil)
+		lost[i] = true
+	}
+}
+
+// claim reports whether a request may go to server, making it the probe
+// if server is half open.
+func (d *OutlierDetector) claim(server string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	h := d.servers[server]
+	if h == nil || !h.ejected {
+		return true
+	}
+	now := time.Now()
+	if now.Before(h.ejectedUntil) {
+		return false
+	}
+	h.probing = true
+	h.ejectedUntil = now.Add(outlierProbeInterval)
+	d.logger.Info("probing ejected server", "server", server)
+	return true
+}
+
+// record counts a request to server.
+func (d *OutlierDetector) record(server string, failed bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	d.expire(now)
+	h := d.servers[server]
+	if h == nil {
+		h = &serverHealth{}
+		d.servers[server] = h
+	}
+	h.lastRequest = now
+	if h.ejected {
+		// Only probes decide whether the server returns; other requests
+		// were sent before it was ejected
+		switch {
+		case !h.probing:
+		case failed:
+			d.eject(server, h, now, "probe failed")
+		default:
+			*h = serverHealth{ejections: h.ejections, recoveredAt: now, windowStart: now, lastRequest: now}
+			d.logger.Info("ejected server recovered", "server", server)
+		}
+		return
+	}
+
+	if now.Sub(h.windowStart) > time.Duration(d.config.Window) {
+		h.requests, h.failures, h.windowStart = 0, 0, now
+	}
+	h.requests++
+	if !failed {
+		h.consecutive = 0
+		return
+	}
+	h.failures++
+	h.consecutive++
+	switch {
+	case d.config.ConsecutiveFailures > 0 && h.consecutive >= d.config.ConsecutiveFailures:
+		d.eject(server, h, now, "consecutive failures")
+	case d.config.ErrorRate > 0 && h.requests >= d.config.MinRequests &&
+		float64(h.failures)*100 >= d.config.ErrorRate*float64(h.requests):
+		d.eject(server, h, now, "error rate")
+	}
+}
+
+func (d *OutlierDetector) eject(server string, h *serverHealth, now time.Time, reason string) {
+	maxEjection := time.Duration(d.config.MaxEjection)
+	if !h.recoveredAt.IsZero() && now.Sub(h.recoveredAt) > maxEjection {
+		h.ejections = 0
+	}
+	ejection := time.Duration(d.config.BaseEjection)
+	for n := 0; n < h.ejections && ejection < maxEjection; n++ {
+		ejection *= 2
+	}
+	ejection = min(ejection, maxEjection)
+	h.ejections++
+	h.ejected, h.probing, h.ejectedUntil = true, false, now.Add(ejection)
+	h.consecutive, h.requests, h.failures = 0, 0, 0
+	d.logger.Warn("ejecting server", "server", server, "reason", reason, "for", ejection.String(), "ejections", h.ejections)
+}
+
+// OutlierStatus is the state of a server, for the admin endpoint.
+type OutlierStatus struct {
+	Server              string     `json:"server"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Requests            int        `json:"requests"`
+	Failures            int        `json:"failures"`
+	Ejections           int        `json:"ejections"`
+	EjectedUntil        *time.Time `json:"ejectedUntil,omitempty"`
+}
+
+// Status returns the state of every server that has had a request
+// recently.
+func (d *OutlierDetector) Status() []OutlierStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	d.expire(now)
+	statuses := make([]OutlierStatus, 0, len(d.servers))
+	for server, h := range d.servers {
+		s := OutlierStatus{
+			Server:              server,
+			State:               "healthy",
+			ConsecutiveFailures: h.consecutive,
+			Requests:            h.requests,
+			Failures:            h.failures,
+			Ejections:           h.ejections,
+		}
+		switch {
+		case h.probing:
+			s.State = "probing"
+		case h.ejected && now.Before(h.ejectedUntil):
+			s.State = "ejected"
+			until := h.ejectedUntil
+			s.EjectedUntil = &until
+		case h.ejected:
+			s.State = "half-open"
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Server < statuses[j].Server
+	})
+	return statuses
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	d := NewOutlierDetector(OutlierConfig{
+		ConsecutiveFailures: 3,
+		BaseEjection:        Duration(20 * time.Millisecond),
+		MaxEjection:         Duration(time.Second),
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	const a = "http://a"
+	exclude := d.excluder([]Backend{{Servers: Servers{URL: a}}})
+
+	d.record(a, true)
+	d.record(a, true)
+	d.record(a, false)
+	d.record(a, true)
+	d.record(a, true)
+	if exclude(0) {
+		t.Fatal("ejected after failures that weren't consecutive")
+	}
+	d.record(a, true)
+	if !exclude(0) {
+		t.Fatal("not ejected after 3 consecutive failures")
+	}
+
+	// Half open: one probe at a time, taken by the request that claims
+	// it, and a failed probe ejects for twice as long
+	time.Sleep(25 * time.Millisecond)
+	if exclude(0) || exclude(0) || d.Status()[0].State != "half-open" {
+		t.Fatalf("half-open server excluded or probed by asking: %+v", d.Status()[0])
+	}
+	if !d.claim(a) {
+		t.Fatal("no probe let through after the ejection")
+	}
+	if !exclude(0) || d.claim(a) {
+		t.Fatal("second probe let through")
+	}
+	d.record(a, true)
+	if s := d.Status()[0]; s.State != "ejected" || s.Ejections != 2 || time.Until(*s.EjectedUntil) < 30*time.Millisecond {
+		t.Fatalf("after a failed probe got %+v", s)
+	}
+
+	time.Sleep(45 * time.Millisecond)
+	if exclude(0) || !d.claim(a) {
+		t.Fatal("no probe let through after the second ejection")
+	}
+	d.record(a, false)
+	if exclude(0) || d.Status()[0].State != "healthy" {
+		t.Fatalf("not recovered after a successful probe: %+v", d.Status()[0])
+	}
+}
+
+func TestOutlierErrorRate(t *testing.T) {
+	d := NewOutlierDetector(OutlierConfig{
+		ErrorRate:    50,
+		MinRequests:  10,
+		Window:       Duration(time.Minute),
+		BaseEjection: Duration(time.Minute),
+		MaxEjection:  Duration(time.Minute),
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for n := 0; n < 9; n++ {
+		d.record("http://a", n%2 == 0)
+	}
+	if d.Status()[0].State != "healthy" {
+		t.Fatal("ejected before the minimum number of requests")
+	}
+	d.record("http://a", true)
+	if d.Status()[0].State != "ejected" {
+		t.Fatalf("not ejected at a 60%% error rate: %+v", d.Status()[0])
+	}
+}
+
+func TestOutlierProbesGoToThePickedBackend(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	halfOpen := func(d *OutlierDetector, server string) {
+		d.record(server, true)
+		time.Sleep(5 * time.Millisecond)
+	}
+	state := func(d *OutlierDetector, server string) string {
+		for _, s := range d.Status() {
+			if s.Server == server {
+				return s.State
+			}
+		}
+		return ""
+	}
+	config := OutlierConfig{ConsecutiveFailures: 1, BaseEjection: Duration(time.Millisecond), MaxEjection: Duration(time.Second)}
+	servers := []Servers{{URL: "http://a"}, {URL: "http://b"}, {URL: "http://c"}}
+
+	// A sticky service probes the server the key hashes to
+	d := NewOutlierDetector(config, logger)
+	sticky, err := newService("probe-sticky", Services{Servers: servers, Sticky: &Sticky{Hash: "header:X-User"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preferred := rendezvous("alice", sticky.Backends, nil)
+	halfOpen(d, sticky.Backends[preferred].URL)
+	pick := func() int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", "alice")
+		i := d.pick(sticky, d.excluder(sticky.Backends), func(exclude func(i int) bool) int {
+			i, _ := sticky.pickBackend(r, exclude)
+			return i
+		})
+		sticky.balancer.Done(i, 0, nil)
+		return i
+	}
+	if i := pick(); i != preferred || state(d, sticky.Backends[i].URL) != "probing" {
+		t.Fatalf("picked %d (%s), want the half-open backend %d probed", i, state(d, sticky.Backends[preferred].URL), preferred)
+	}
+	if i := pick(); i == preferred || i < 0 {
+		t.Fatalf("picked %d while backend %d was being probed", i, preferred)
+	}
+
+	// A balancer looking at every backend doesn't use up the probe of a
+	// half-open one it doesn't pick
+	d = NewOutlierDetector(config, logger)
+	lo, err := newService("probe-least-outstanding", Services{Servers: servers[:2], Balancer: balancerLeastOutstanding}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	halfOpen(d, "http://a")
+	busy := lo.balancer.Pick(func(i int) bool { return i != 0 })
+	defer lo.balancer.Done(busy, 0, nil)
+	if i := d.pick(lo, d.excluder(lo.Backends), lo.balancer.Pick); i != 1 || state(d, "http://a") != "half-open" {
+		t.Fatalf("picked %d leaving a %s, want b picked and a still half open", i, state(d, "http://a"))
+	}
+	if i := d.pick(lo, func(i int) bool { return i == 1 }, lo.balancer.Pick); i != 0 || state(d, "http://a") != "probing" {
+		t.Fatalf("picked %d leaving a %s, want a probed", i, state(d, "http://a"))
+	}
+}
+
+func TestOutlierDetectorForgetsIdleServers(t *testing.T) {
+	d := NewOutlierDetector(OutlierConfig{
+		ConsecutiveFailures: 1,
+		BaseEjection:        Duration(time.Hour),
+		MaxEjection:         Duration(time.Hour),
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	d.record("http://gone", false)
+	d.record("http://ejected", true)
+
+	// Long after their last requests, only the server still ejected is
+	// remembered
+	d.mutex.Lock()
+	for _, h := range d.servers {
+		h.lastRequest = h.lastRequest.Add(-2 * time.Hour)
+	}
+	d.expiredAt = d.expiredAt.Add(-2 * time.Hour)
+	d.mutex.Unlock()
+	statuses := d.Status()
+	if len(statuses) != 1 || statuses[0].Server != "http://ejected" {
+		t.Errorf("got %+v, want only the ejected server", statuses)
+	}
+}
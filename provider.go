@@ -0,0 +1,412 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Provider is a source of routing config, such as the control plane, a
+// file or command line flags.
+//
+// Routes must not block once the provider has a config, and must return
+// the same *RouteTable for as long as its config is unchanged.
+type Provider interface {
+	Name() string
+	Routes() (*RouteTable, error)
+}
+
+func (c *TTLCache) Name() string {
+	return "control-plane"
+}
+
+func (p *FileProvider) Name() string {
+	return "file:" + p.Path
+}
+
+// Providers merges the configs of several providers into one route table.
+// Earlier providers take precedence: the routers of a later provider are
+// left out if they match a host that an earlier one routes, a service
+// defined by more than one provider comes from the first, and every
+// conflict is reported. Routers of equal priority that still overlap,
+// such as ones matching any host, are tried in order of precedence.
+//
+// Every merged config is recorded in a bounded history, and any config in
+// it can be pinned to be served instead of the live one. Merged configs
+// are compiled with the server state in states, which is kept only for
+// the servers of the tables being served.
+type Providers struct {
+	providers []Provider
+	logger    *slog.Logger
+	states    *serverStates
+	mutex     sync.Mutex
+	merged    atomic.Pointer[merge]
+	history   *configHistory
+	pinned    atomic.Pointer[RouteTable]
+}
+
+// merge is the result of merging the tables in sources. If they didn't
+// compile together, err says why and routes is the last good merge.
+// unloaded is why the providers left out for want of a config have none.
+type merge struct {
+	sources   []*RouteTable
+	routes    *RouteTable
+	conflicts []string
+	err       error
+	unloaded  error
+}
+
+func (m *merge) result() (*RouteTable, error) {
+	if m.routes == nil {
+		return nil, m.err
+	}
+	return m.routes, nil
+}
+
+// ProviderStatus describes a provider's part in the merged config.
+type ProviderStatus struct {
+	Name     string `json:"name"`
+	Routers  int    `json:"routers"`
+	Services int    `json:"services"`
+	Error    string `json:"error,omitempty"`
+}
+
+func NewProviders(logger *slog.Logger, states *serverStates, providers ...Provider) *Providers {
+	return &Providers{
+		providers: providers,
+		logger:    logger,
+		states:    states,
+		history:   newConfigHistory(32, logger),
+	}
+}
+
+// Routes returns the pinned route table if there is one, and otherwise
+// the merged one.
+func (m *Providers) Routes() (*RouteTable, error) {
+	// Keep merging while pinned, so that the history stays current
+	routes, err := m.merge()
+	if pinned := m.pinned.Load(); pinned != nil {
+		return pinned, nil
+	}
+	return routes, err
+}
+
+// merge returns the merged route table, remerging only when one of the
+// providers has a new table. A provider without a config is left out
+// until it has one; merge fails if none has a config, not counting the
+// built-in routers, which only fill in for the others. Tables that don't
+// compile together are merged once, and the last good merge is served
+// until a provider changes again.
+func (m *Providers) merge() (*RouteTable, error) {
+	sources := make([]*RouteTable, len(m.providers))
+	var unloaded []error
+	loaded := 0
+	for i, p := range m.providers {
+		routes, err := p.Routes()
+		sources[i] = routes
+		switch {
+		case isBuiltinProvider(p):
+		case routes != nil:
+			loaded++
+		case err != nil:
+			unloaded = append(unloaded, fmt.Errorf("%s: %w", p.Name(), err))
+		default:
+			unloaded = append(unloaded, fmt.Errorf("%s: no config", p.Name()))
+		}
+	}
+
+	if merged := m.merged.Load(); merged != nil && slices.Equal(merged.sources, sources) {
+		return merged.result()
+	}
+	if loaded == 0 {
+		return nil, errors.Join(append(unloaded, errors.New("no routing config"))...)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Another request may have merged the same tables while we waited
+	last := m.merged.Load()
+	if last != nil && slices.Equal(last.sources, sources) {
+		return last.result()
+	}
+
+	configs := make([]Config, len(m.providers))
+	names := make([]string, len(m.providers))
+	for i, p := range m.providers {
+		names[i] = p.Name()
+		if sources[i] != nil {
+			configs[i] = sources[i].Config()
+		}
+	}
+	config, ranks, conflicts := mergeConfigs(names, configs)
+	for _, c := range conflicts {
+		m.logger.Warn("config conflict", "conflict", c)
+	}
+	routes, err := compileMergedRoutes(config, ranks, m.states)
+	if err != nil {
+		err = fmt.Errorf("error compiling merged config: %w", err)
+		failed := &merge{sources: sources, conflicts: conflicts, err: err, unloaded: errors.Join(unloaded...)}
+		if last != nil && last.routes != nil {
+			failed.routes = last.routes
+			m.logger.Error("merged config doesn't compile, serving the last good one", "err", err, "version", last.routes.Version())
+		} else {
+			m.logger.Error("merged config doesn't compile", "err", err)
+		}
+		m.merged.Store(failed)
+		m.keepStates()
+		return failed.result()
+	}
+
+	m.merged.Store(&merge{sources: sources, routes: routes, conflicts: conflicts, unloaded: errors.Join(unloaded...)})
+	m.keepStates()
+	m.history.record(routes)
+	return routes, nil
+}
+
+// keepStates drops the state of servers that neither the merged nor the
+// pinned table routes to. It must be called with mutex held.
+func (m *Providers) keepStates() {
+	var merged *RouteTable
+	if last := m.merged.Load(); last != nil {
+		merged = last.routes
+	}
+	m.states.keep(merged, m.pinned.Load())
+}
+
+// Pin serves the config with the given version from the history until
+// Unpin is called, regardless of what the providers say.
+func (m *Providers) Pin(version string) error {
+	routes, err := m.history.find(version)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.pinned.Store(routes)
+	m.keepStates()
+	m.mutex.Unlock()
+	m.logger.Warn("config pinned", "version", version)
+	return nil
+}
+
+// Unpin goes back to serving the live config.
+func (m *Providers) Unpin() {
+	m.mutex.Lock()
+	pinned := m.pinned.Swap(nil)
+	m.keepStates()
+	m.mutex.Unlock()
+	if pinned != nil {
+		m.logger.Warn("config unpinned")
+	}
+}
+
+// Unloaded returns why the providers that have never had a config have
+// none, or nil if they all have one. A request that isn't routed may be
+// for one of them.
+func (m *Providers) Unloaded() error {
+	if merged := m.merged.Load(); merged != nil {
+		return merged.unloaded
+	}
+	return nil
+}
+
+// Pinned returns the version of the pinned config, if any.
+func (m *Providers) Pinned() string {
+	if pinned := m.pinned.Load(); pinned != nil {
+		return pinned.Version()
+	}
+	return ""
+}
+
+// Status reports what each provider contributes and the conflicts found
+// in the last merge.
+func (m *Providers) Status() ([]ProviderStatus, []string) {
+	statuses := make([]ProviderStatus, len(m.providers))
+	for i, p := range m.providers {
+		statuses[i].Name = p.Name()
+		routes, err := p.Routes()
+		if err != nil {
+			statuses[i].Error = err.Error()
+		}
+		if routes != nil {
+			statuses[i].Routers = len(routes.config.Http.Routers)
+			statuses[i].Services = len(routes.config.Http.Services)
+		}
+	}
+
+	var conflicts []string
+	if merged := m.merged.Load(); merged != nil {
+		conflicts = merged.conflicts
+	}
+	return statuses, conflicts
+}
+
+// mergeConfigs merges configs in order of precedence, reporting every
+// router or service that is shadowed by an earlier definition. A router is
+// shadowed by one of the same name, or by the routers of an earlier config
+// for any of the hosts its rule matches. It also returns the index of the
+// config each router came from.
+func mergeConfigs(names []string, configs []Config) (Config, map[string]int, []string) {
+	merged := Config{Http: Http{
+		Routers:  map[string]Routers{},
+		Services: map[string]Services{},
+	}}
+	ranks := map[string]int{}
+	hostFrom := map[string]string{}
+	serviceFrom := map[string]string{}
+	var conflicts []string
+
+	for i, c := range configs {
+		hosts := map[string]bool{}
+		for _, name := range sortedKeys(c.Http.Routers) {
+			r := c.Http.Routers[name]
+			if _, ok := merged.Http.Routers[name]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("router %s from %s is shadowed by %s", name, names[i], names[ranks[name]]))
+				continue
+			}
+			// The config compiled on its own, so its rules parse
+			parsed, _ := parseRule(r.ruleText(name))
+			var ruleHosts []string
+			if parsed != nil {
+				ruleHosts = parsed.hosts()
+			}
+			shadowed := false
+			for _, host := range ruleHosts {
+				if from, ok := hostFrom[host]; ok {
+					conflicts = append(conflicts, fmt.Sprintf("router %s from %s is shadowed by %s, which routes %s", name, names[i], from, displayHost(host)))
+					shadowed = true
+					break
+				}
+			}
+			if shadowed {
+				continue
+			}
+			for _, host := range ruleHosts {
+				hosts[host] = true
+			}
+			ranks[name] = i
+			merged.Http.Routers[name] = r
+		}
+		// A config's own routers may share hosts; only later ones are
+		// shadowed
+		for host := range hosts {
+			hostFrom[host] = names[i]
+		}
+		for _, id := range sortedKeys(c.Http.Services) {
+			if from, ok := serviceFrom[id]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("service %s from %s is shadowed by %s", id, names[i], from))
+				continue
+			}
+			serviceFrom[id] = names[i]
+			merged.Http.Services[id] = c.Http.Services[id]
+		}
+	}
+	return merged, ranks, conflicts
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// StaticProvider serves routes given on the command line as repeated
+// -route host=url flags. Each host gets a single-server service of its
+// own named static:host.
+type StaticProvider struct {
+	name   string
+	routes *RouteTable
+	config Config
+	// builtin is set for the proxy config's built-in routers
+	builtin bool
+}
+
+// newStaticProvider returns a StaticProvider serving c.
+func newStaticProvider(name string, c Config) (*StaticProvider, error) {
+	routes, err := compileRoutes(c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &StaticProvider{name: name, routes: routes, config: c}, nil
+}
+
+// newBuiltinProvider returns the provider of the proxy config's routers,
+// which always has a config but doesn't count as one for Providers.
+func newBuiltinProvider(routing Http) (*StaticProvider, error) {
+	p, err := newStaticProvider("proxy-config", Config{Http: routing})
+	if err != nil {
+		return nil, err
+	}
+	p.builtin = true
+	return p, nil
+}
+
+func isBuiltinProvider(p Provider) bool {
+	static, ok := p.(*StaticProvider)
+	return ok && static.builtin
+}
+
+func (p *StaticProvider) Name() string {
+	if p.name == "" {
+		return "flags"
+	}
+	return p.name
+}
+
+func (p *StaticProvider) Routes() (*RouteTable, error) {
+	if p.routes == nil {
+		return nil, fmt.Errorf("no static routes")
+	}
+	return p.routes, nil
+}
+
+func (p *StaticProvider) String() string {
+	var routes []string
+	for _, host := range sortedKeys(p.config.Http.Routers) {
+		service := p.config.Http.Services[p.config.Http.Routers[host].Service]
+		routes = append(routes, host+"="+service.Servers[0].URL)
+	}
+	return strings.Join(routes, ",")
+}
+
+// Set implements flag.Value.
+func (p *StaticProvider) Set(value string) error {
+	host, target, ok := strings.Cut(value, "=")
+	if !ok || host == "" {
+		return fmt.Errorf("expected host=url, got %q", value)
+	}
+	if _, err := url.Parse(target); err != nil {
+		return err
+	}
+	if p.config.Http.Routers == nil {
+		p.config.Http.Routers = map[string]Routers{}
+		p.config.Http.Services = map[string]Services{}
+	}
+	id := "static:" + host
+	p.config.Http.Routers[host] = Routers{Service: id}
+	p.config.Http.Services[id] = Services{Servers: []Servers{{URL: target}}}
+
+	routes, err := compileRoutes(p.config)
+	if err != nil {
+		return err
+	}
+	p.routes = routes
+	return nil
+}
+
+// displayHost writes a host from rule.hosts the way it is configured,
+// with a suffix as a wildcard.
+func displayHost(host string) string {
+	if strings.HasPrefix(host, ".") {
+		return "*" + host
+	}
+	return host
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustCompile(t *testing.T, config string) *RouteTable {
+	t.Helper()
+	routes, err := compileConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routes
+}
+
+func TestProvidersKeepLastGoodMerge(t *testing.T) {
+	// Each config compiles on its own, but the second one's mirror is
+	// shadowed by the first one's built-in service of the same name
+	builtin := &swappableProvider{mustCompile(t, `{"http":{"routers":{"a.flakery.xyz":{"service":"m"}},"services":{"m":{"type":"static-response","status":204}}}}`)}
+	good := mustCompile(t, polledConfig)
+	broken := mustCompile(t, `{"http":{
+		"routers":{"b.flakery.xyz":{"service":"s","mirror":{"service":"m"}}},
+		"services":{"s":{"servers":[{"url":"http://s:8080"}]},"m":{"servers":[{"url":"http://m:8080"}]}}}}`)
+	source := &swappableProvider{good}
+	providers := NewProviders(slog.New(slog.NewTextHandler(io.Discard, nil)), newServerStates(), builtin, source)
+
+	first, err := providers.Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.routes = broken
+	for range 2 {
+		if routes, err := providers.Routes(); err != nil || routes != first {
+			t.Fatalf("broken merge served %p (%v), want the last good table %p", routes, err, first)
+		}
+	}
+	if n := len(providers.history.Entries()); n != 1 {
+		t.Errorf("%d history entries, want only the good merge", n)
+	}
+
+	source.routes = good
+	if routes, err := providers.Routes(); err != nil || routes == first {
+		t.Errorf("remerged %p (%v), want a new table", routes, err)
+	}
+
+	// Without a good merge to fall back on, the error is reported
+	providers = NewProviders(slog.New(slog.NewTextHandler(io.Discard, nil)), newServerStates(), builtin, &swappableProvider{broken})
+	if _, err := providers.Routes(); err == nil {
+		t.Error("broken merge without a last good one succeeded")
+	}
+}
+
+func TestMergeConfigsByHost(t *testing.T) {
+	servers := func(url string) Services { return Services{Servers: []Servers{{URL: url}}} }
+	configs := []Config{
+		{Http: Http{
+			Routers:  map[string]Routers{"a.flakery.xyz": {Service: "flags"}},
+			Services: map[string]Services{"flags": servers("http://flags")},
+		}},
+		{Http: Http{
+			Routers: map[string]Routers{
+				"api":   {Rule: "Host(`a.flakery.xyz`) && PathPrefix(`/api`)", Service: "file"},
+				"b":     {Rule: "Host(`b.flakery.xyz`)", Service: "file"},
+				"z-any": {Rule: "PathPrefix(`/`)", Priority: 1, Service: "file"},
+			},
+			Services: map[string]Services{"file": servers("http://file")},
+		}},
+		{Http: Http{
+			Routers: map[string]Routers{
+				"b.flakery.xyz": {Service: "control-plane"},
+				"preview":       {Rule: "Host(`{name}.preview.flakery.xyz`)", Service: "control-plane"},
+				"a-any":         {Rule: "PathPrefix(`/`)", Priority: 1, Service: "control-plane"},
+			},
+			Services: map[string]Services{"control-plane": servers("http://control-plane")},
+		}},
+	}
+	config, ranks, conflicts := mergeConfigs([]string{"flags", "file", "control-plane"}, configs)
+	want := []string{
+		"router api from file is shadowed by flags, which routes a.flakery.xyz",
+		"router b.flakery.xyz from control-plane is shadowed by file, which routes b.flakery.xyz",
+	}
+	if !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("conflicts %q, want %q", conflicts, want)
+	}
+	routes, err := compileMergedRoutes(config, ranks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ host, path, service string }{
+		{"a.flakery.xyz", "/api", "flags"},
+		{"b.flakery.xyz", "/", "file"},
+		{"x.preview.flakery.xyz", "/", "control-plane"},
+		// Catch-alls of equal priority are tried in provider order
+		{"c.flakery.xyz", "/", "file"},
+	} {
+		match, ok := routes.Lookup(tt.host, httptest.NewRequest("GET", tt.path, nil))
+		if !ok || match.Service.ID != tt.service {
+			t.Errorf("%s%s routed to %+v, want %s", tt.host, tt.path, match, tt.service)
+		}
+	}
+}
+
+func TestProvidersKeepOnlyServedServerState(t *testing.T) {
+	table := func(servers string) *RouteTable {
+		return mustCompile(t, `{"http":{"routers":{"a.flakery.xyz":{"service":"a"}},
+			"services":{"a":{"servers":[`+servers+`],"circuitBreaker":{}}}}}`)
+	}
+	both := table(`{"url":"http://a1"},{"url":"http://a2"}`)
+	source := &swappableProvider{both}
+	states := newServerStates()
+	providers := NewProviders(slog.New(slog.NewTextHandler(io.Discard, nil)), states, source)
+	servers := func() []string {
+		var servers []string
+		for _, c := range states.breakers.Status() {
+			servers = append(servers, c.Service+" "+c.Server)
+		}
+		if len(states.balancers.loads) != len(servers) {
+			t.Errorf("balancer state for %d servers, circuits for %v", len(states.balancers.loads), servers)
+		}
+		return servers
+	}
+
+	first, err := providers.Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := servers(), []string{"a http://a1", "a http://a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("state for %q, want %q", got, want)
+	}
+	source.routes = table(`{"url":"http://a1"}`)
+	second, _ := providers.Routes()
+	if got, want := servers(), []string{"a http://a1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("state for %q after a server was removed, want %q", got, want)
+	}
+	if first.services["a"].breakers[0] != second.services["a"].breakers[0] {
+		t.Error("the remaining server's circuit didn't carry over")
+	}
+	if first.services["a"].budget != second.services["a"].budget {
+		t.Error("the service's retry budget didn't carry over")
+	}
+
+	// A pinned table keeps its servers' state
+	if err := providers.Pin(first.Version()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := servers(), []string{"a http://a1", "a http://a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("state for %q while pinned, want %q", got, want)
+	}
+	providers.Unpin()
+	if got, want := servers(), []string{"a http://a1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("state for %q after unpinning, want %q", got, want)
+	}
+
+	// A service that is gone loses its retry budget
+	source.routes = mustCompile(t, `{"http":{"routers":{"b.flakery.xyz":{"service":"b"}},
+		"services":{"b":{"servers":[{"url":"http://b1"}]}}}}`)
+	providers.Routes()
+	if _, ok := states.budgets.budgets["a"]; ok || len(states.budgets.budgets) != 1 {
+		t.Errorf("retry budgets for %v, want only b", sortedKeys(states.budgets.budgets))
+	}
+}
+
+func TestProvidersWithoutConfig(t *testing.T) {
+	builtins, err := newBuiltinProvider(builtinConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The built-in routers alone aren't a config
+	controlPlane := &swappableProvider{}
+	providers := NewProviders(logger, newServerStates(), controlPlane, builtins)
+	if routes, err := providers.Routes(); err == nil {
+		t.Errorf("got routes %s with only the built-in ones", routes.Version())
+	}
+
+	// With another provider loaded, the one that isn't is reported
+	static, err := newStaticProvider("flags", Config{Http: Http{
+		Routers:  map[string]Routers{"b.flakery.xyz": {Service: "b"}},
+		Services: map[string]Services{"b": {Servers: []Servers{{URL: "http://b"}}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers = NewProviders(logger, newServerStates(), static, controlPlane, builtins)
+	if _, err := providers.Routes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := providers.Unloaded(); err == nil || !strings.Contains(err.Error(), "test") {
+		t.Errorf("got unloaded %v, want the control plane", err)
+	}
+	controlPlane.routes = mustCompile(t, polledConfig)
+	if _, err := providers.Routes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := providers.Unloaded(); err != nil {
+		t.Errorf("got unloaded %v once every provider has a config", err)
+	}
+}
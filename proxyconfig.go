@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ProxyConfig is the static configuration of the proxy itself, as opposed
+// to the routing config that comes from providers. It is read from the
+// file given by -proxy-config, then overridden by TINY_SSL_* environment
+// variables and finally by command line flags.
+type ProxyConfig struct {
+	Listen         string   `json:"listen"`
+	AdminListen    string   `json:"adminListen"`
+	Where          string   `json:"where"`
+	CatchAll       bool     `json:"catchAll"`
+	TLS            bool     `json:"tls"`
+	Logging        bool     `json:"logging"`
+	BehindTCPProxy bool     `json:"behindTCPProxy"`
+	FlushInterval  Duration `json:"flushInterval"`
+
+	// Certificates served on the TLS listener. Cert and Key, if set,
+	// replace them with a single certificate.
+	Certificates []CertKey `json:"certificates"`
+	Cert         string    `json:"cert"`
+	Key          string    `json:"key"`
+
+	// Routing is routing config served alongside that of the providers,
+	// at the lowest precedence. It starts with builtinConfig, which it can
+	// override router by router and service by service.
+	Routing Http `json:"http"`
+
+	HTTPListener HTTPListenerConfig `json:"httpListener"`
+	Hosts        SpecialHosts       `json:"hosts"`
+	HealthCheck  HealthCheckConfig  `json:"healthCheck"`
+	Outliers     OutlierConfig      `json:"outlierDetection"`
+	Retries      RetryConfig        `json:"retries"`
+	ControlPlane ControlPlaneConfig `json:"controlPlane"`
+	ConfigFile   string             `json:"configFile"`
+	StateFile    string             `json:"stateFile"`
+	StateMaxAge  Duration           `json:"stateMaxAge"`
+}
+
+type CertKey struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// SpecialHosts are hosts handled by the proxy rather than by the routing
+// config.
+type SpecialHosts struct {
+	// PrivateCache routes each user to their private binary cache,
+	// looked up at PrivateCacheAPI.
+	PrivateCache    string `json:"privateCache"`
+	PrivateCacheAPI string `json:"privateCacheAPI"`
+}
+
+// normalize puts the hosts in the form requests are matched in.
+func (h *SpecialHosts) normalize() {
+	h.PrivateCache = normalizeHost(h.PrivateCache)
+}
+
+type HealthCheckConfig struct {
+	Interval Duration `json:"interval"`
+	Port     int      `json:"port"`
+	Path     string   `json:"path"`
+	// Threshold is the number of consecutive failed checks after which a
+	// host is reported unhealthy to the control plane.
+	Threshold int `json:"threshold"`
+}
+
+type ControlPlaneConfig struct {
+	Enabled       bool     `json:"enabled"`
+	BaseURL       string   `json:"baseURL"`
+	ConfigPath    string   `json:"configPath"`
+	StreamPath    string   `json:"streamPath"`
+	UnhealthyPath string   `json:"unhealthyPath"`
+	TTL           Duration `json:"ttl"`
+	Stream        bool     `json:"stream"`
+}
+
+func (c ControlPlaneConfig) ConfigURL() string {
+	return c.BaseURL + c.ConfigPath
+}
+
+func (c ControlPlaneConfig) StreamURL() string {
+	return c.BaseURL + c.StreamPath
+}
+
+func (c ControlPlaneConfig) UnhealthyURL(deployment string) string {
+	return c.BaseURL + c.UnhealthyPath + deployment
+}
+
+func defaultProxyConfig() ProxyConfig {
+	return ProxyConfig{
+		Listen:      ":443",
+		AdminListen: "localhost:9003",
+		Where:       "http://10.0.4.20:3000",
+		TLS:         true,
+		Logging:     true,
+		Certificates: []CertKey{
+			{"/var/lib/acme/flakery.xyz/cert.pem", "/var/lib/acme/flakery.xyz/key.pem"},
+			{"/var/lib/acme/flakery.dev/cert.pem", "/var/lib/acme/flakery.dev/key.pem"},
+		},
+		Routing: builtinConfig(),
+		Hosts: SpecialHosts{
+			PrivateCache:    "wp.flakery.xyz",
+			PrivateCacheAPI: "https://flakery.dev/api/v0/user/private-binary-cache/",
+		},
+		HealthCheck: HealthCheckConfig{
+			Interval:  Duration(5 * time.Second),
+			Port:      9002,
+			Path:      "/metrics",
+			Threshold: 4,
+		},
+		Outliers: OutlierConfig{
+			ConsecutiveFailures: 5,
+			ErrorRate:           50,
+			MinRequests:         20,
+			Window:              Duration(10 * time.Second),
+			BaseEjection:        Duration(30 * time.Second),
+			MaxEjection:         Duration(5 * time.Minute),
+		},
+		Retries: RetryConfig{
+			Attempts:    2,
+			Budget:      20,
+			MaxBodySize: defaultRetryBodySize,
+		},
+		ControlPlane: ControlPlaneConfig{
+			Enabled:       true,
+			BaseURL:       "http://localhost:3000",
+			ConfigPath:    "/api/deployments/lb-config-ng",
+			StreamPath:    "/api/deployments/lb-config-ng/stream",
+			UnhealthyPath: "/api/deployments/target/unhealthy/",
+			TTL:           Duration(5 * time.Second),
+		},
+		StateFile:   "/var/lib/tiny-ssl-reverse-proxy/lb-config-ng.json",
+		StateMaxAge: Duration(24 * time.Hour),
+	}
+}
+
+// TLSCertificates returns the certificate and key pairs to serve.
+func (c ProxyConfig) TLSCertificates() []CertKey {
+	if c.Cert != "" || c.Key != "" {
+		return []CertKey{{c.Cert, c.Key}}
+	}
+	return c.Certificates
+}
+
+// Duration is a time.Duration written as a string such as "5s" in config
+// files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// proxyFlags holds what is set on the command line besides ProxyConfig.
+type proxyFlags struct {
+	proxyConfig     string
+	onlyHealthcheck bool
+	routes          StaticProvider
+}
+
+func defineFlags(fs *flag.FlagSet, c *ProxyConfig, f *proxyFlags) {
+	fs.StringVar(&f.proxyConfig, "proxy-config", os.Getenv("TINY_SSL_PROXY_CONFIG"), "Path to a JSON or YAML proxy configuration file")
+	fs.BoolVar(&f.onlyHealthcheck, "only-healthcheck", false, "only run healthcheck")
+	fs.Var(&f.routes, "route", "static host=url route taking precedence over all other config (repeatable)")
+
+	fs.StringVar(&c.Listen, "listen", c.Listen, "Bind address to listen on")
+	fs.StringVar(&c.HTTPListener.Listen, "http-listen", c.HTTPListener.Listen, "Bind address for plain HTTP, redirected to HTTPS (empty to disable)")
+	fs.StringVar(&c.HTTPListener.ACMEChallengeDir, "acme-challenge-dir", c.HTTPListener.ACMEChallengeDir, "Directory to serve ACME HTTP-01 challenges from on the plain HTTP listener")
+	fs.StringVar(&c.HTTPListener.ACMEChallengeURL, "acme-challenge-url", c.HTTPListener.ACMEChallengeURL, "URL to forward ACME HTTP-01 challenges on the plain HTTP listener to")
+	fs.StringVar(&c.AdminListen, "admin-listen", c.AdminListen, "Bind address for the admin endpoints (empty to disable)")
+	fs.StringVar(&c.Key, "key", c.Key, "Path to PEM key, replacing the configured certificates")
+	fs.StringVar(&c.Cert, "cert", c.Cert, "Path to PEM certificate, replacing the configured certificates")
+	fs.StringVar(&c.Where, "where", c.Where, "Place to forward connections to")
+	fs.BoolVar(&c.CatchAll, "catch-all", c.CatchAll, "forward requests for hosts without a router to -where instead of answering 404")
+	fs.BoolVar(&c.TLS, "tls", c.TLS, "accept HTTPS connections")
+	fs.BoolVar(&c.Logging, "logging", c.Logging, "log requests")
+	fs.BoolVar(&c.BehindTCPProxy, "behind-tcp-proxy", c.BehindTCPProxy, "running behind TCP proxy (such as ELB or HAProxy)")
+	fs.DurationVar((*time.Duration)(&c.FlushInterval), "flush-interval", time.Duration(c.FlushInterval), "minimum duration between flushes to the client (default: off)")
+	fs.StringVar(&c.ControlPlane.BaseURL, "control-plane-url", c.ControlPlane.BaseURL, "Base URL of the control plane API")
+	fs.DurationVar((*time.Duration)(&c.ControlPlane.TTL), "config-ttl", time.Duration(c.ControlPlane.TTL), "how often to poll the control plane for routing config")
+	fs.BoolVar(&c.ControlPlane.Stream, "config-stream", c.ControlPlane.Stream, "subscribe to routing config updates pushed by the control plane, polling only while disconnected")
+	fs.BoolVar(&c.ControlPlane.Enabled, "control-plane", c.ControlPlane.Enabled, "route the deployments configured by the control plane")
+	fs.StringVar(&c.ConfigFile, "config-file", c.ConfigFile, "Path to a JSON or YAML routing config file, or a directory of them, taking precedence over the control plane")
+	fs.StringVar(&c.StateFile, "state-file", c.StateFile, "Path to persist the last good routing config to (empty to disable)")
+	fs.DurationVar((*time.Duration)(&c.StateMaxAge), "state-max-age", time.Duration(c.StateMaxAge), "maximum age of a persisted routing config to use at startup (0 for no limit)")
+}
+
+// flagEnv returns the environment variable overriding a flag, for example
+// TINY_SSL_CONFIG_TTL for -config-ttl.
+func flagEnv(name string) string {
+	return "TINY_SSL_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// parseProxyConfig works out the proxy configuration from the config file,
+// the environment and args. The flags are parsed twice: first to find the
+// config file, then with its values as defaults so that only flags given
+// explicitly override it.
+func parseProxyConfig(name string, args []string) (ProxyConfig, proxyFlags, error) {
+	c := defaultProxyConfig()
+	var f proxyFlags
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	defineFlags(fs, &c, &f)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "\n%v version %v\n\n", name, Version)
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", name)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEvery flag can also be set with an environment variable such as %s.\n", flagEnv("config-ttl"))
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, f, err
+	}
+
+	c = defaultProxyConfig()
+	if f.proxyConfig != "" {
+		body, err := os.ReadFile(f.proxyConfig)
+		if err != nil {
+			return c, f, err
+		}
+		if body, err = yamlToJSON(f.proxyConfig, body); err == nil {
+			err = json.Unmarshal(body, &c)
+		}
+		if err != nil {
+			return c, f, fmt.Errorf("%s: %w", f.proxyConfig, err)
+		}
+	}
+	// FLAKERY_BASE_URL predates the TINY_SSL_* variables
+	if baseURL := os.Getenv("FLAKERY_BASE_URL"); baseURL != "" {
+		c.ControlPlane.BaseURL = baseURL
+	}
+
+	f = proxyFlags{}
+	fs = flag.NewFlagSet(name, flag.ExitOnError)
+	defineFlags(fs, &c, &f)
+	var err error
+	fs.VisitAll(func(fl *flag.Flag) {
+		if v, ok := os.LookupEnv(flagEnv(fl.Name)); ok && err == nil && fl.Name != "proxy-config" {
+			if err = fs.Set(fl.Name, v); err != nil {
+				err = fmt.Errorf("%s: %w", flagEnv(fl.Name), err)
+			}
+		}
+	})
+	if err != nil {
+		return c, f, err
+	}
+	if err = fs.Parse(args); err != nil {
+		return c, f, err
+	}
+	c.Hosts.normalize()
+	return c, f, c.validate()
+}
+
+// validate reports settings that would otherwise only fail once running,
+// such as an interval that time.Tick can't tick at.
+func (c ProxyConfig) validate() error {
+	var errs []error
+	if c.HealthCheck.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("healthCheck.interval must be positive, not %v", time.Duration(c.HealthCheck.Interval)))
+	}
+	if c.ControlPlane.TTL <= 0 {
+		errs = append(errs, fmt.Errorf("controlPlane.ttl must be positive, not %v", time.Duration(c.ControlPlane.TTL)))
+	}
+	if c.StateMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("stateMaxAge must not be negative"))
+	}
+	return errors.Join(errs...)
+}
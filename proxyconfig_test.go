@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProxyConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	if err := os.WriteFile(path, []byte(`
+listen: ":1"
+adminListen: ":2"
+where: http://file
+httpListener:
+  listen: ":80"
+controlPlane:
+  baseURL: http://file-control-plane
+  ttl: 1m
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TINY_SSL_PROXY_CONFIG", path)
+	t.Setenv("TINY_SSL_ADMIN_LISTEN", ":20")
+	t.Setenv("TINY_SSL_WHERE", "http://env")
+	t.Setenv("FLAKERY_BASE_URL", "http://flakery")
+
+	c, _, err := parseProxyConfig("test", []string{"-where", "http://flag", "-config-ttl", "2m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"listen from the file", c.Listen, ":1"},
+		{"httpListener from the file", c.HTTPListener.Listen, ":80"},
+		{"adminListen from the environment", c.AdminListen, ":20"},
+		{"where from the flag", c.Where, "http://flag"},
+		{"ttl from the flag", time.Duration(c.ControlPlane.TTL), 2 * time.Minute},
+		{"baseURL from FLAKERY_BASE_URL", c.ControlPlane.BaseURL, "http://flakery"},
+		{"tls by default", c.TLS, true},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// Flags also win over FLAKERY_BASE_URL
+	c, _, err = parseProxyConfig("test", []string{"-control-plane-url", "http://flag-control-plane"})
+	if err != nil || c.ControlPlane.BaseURL != "http://flag-control-plane" {
+		t.Errorf("got base URL %q (%v)", c.ControlPlane.BaseURL, err)
+	}
+}
+
+func TestParseProxyConfigRejectsIntervals(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		args   []string
+		err    string
+	}{
+		{`{"healthCheck":{"interval":"0s"}}`, nil, "healthCheck.interval"},
+		{`{"healthCheck":{"interval":"-5s"}}`, nil, "healthCheck.interval"},
+		{`{}`, []string{"-config-ttl", "0s"}, "controlPlane.ttl"},
+		{`{"stateMaxAge":"-1h"}`, nil, "stateMaxAge"},
+	} {
+		path := filepath.Join(t.TempDir(), "proxy.json")
+		if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := parseProxyConfig("test", append([]string{"-proxy-config", path}, tt.args...))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %v: got error %v, want %q", tt.config, tt.args, err, tt.err)
+		}
+	}
+}
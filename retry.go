@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const (
+	defaultRetryBodySize = 64 << 10
+	// retryBudgetReserve is the number of retries allowed before any
+	// requests have paid for them, and retryBudgetMax the most that can
+	// be saved up.
+	retryBudgetReserve = 10
+	retryBudgetMax     = 100
+)
+
+// RetryConfig configures retrying failed requests on other servers of
+// their service.
+type RetryConfig struct {
+	// Attempts is how many times a request may be retried (0 to
+	// disable). Requests that couldn't connect are always retried, other
+	// failed requests only if their method is idempotent.
+	Attempts int `json:"attempts"`
+	// OnGatewayErrors also retries idempotent requests answered with 502,
+	// 503 or 504.
+	OnGatewayErrors bool `json:"onGatewayErrors"`
+	// Budget is the percentage of requests that may be retried, so that
+	// retries can't multiply the load when every server is struggling.
+	Budget float64 `json:"budget"`
+	// Request bodies up to MaxBodySize are kept as they are sent, to be
+	// sent again; requests with larger bodies are only retried if they
+	// never reached a server.
+	MaxBodySize int64 `json:"maxBodySize"`
+}
+
+// retryBudget is a balance of retries, which each request adds a
+// fraction of a retry to.
+type retryBudget struct {
+	mutex   sync.Mutex
+	balance float64
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{balance: retryBudgetReserve}
+}
+
+func (b *retryBudget) deposit(percent float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.balance = min(b.balance+percent/100, retryBudgetMax)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// retryBudgets holds the retry budget of each service, so that a failing
+// service can't spend the retries of the others. It is kept by
+// serverStates.
+type retryBudgets struct {
+	mutex   sync.Mutex
+	budgets map[string]*retryBudget
+}
+
+func newRetryBudgets() *retryBudgets {
+	return &retryBudgets{budgets: map[string]*retryBudget{}}
+}
+
+func (b *retryBudgets) get(service string) *retryBudget {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	budget, ok := b.budgets[service]
+	if !ok {
+		budget = newRetryBudget()
+		b.budgets[service] = budget
+	}
+	return budget
+}
+
+// replayBody is a request body that keeps what the first attempt reads of
+// it, up to max bytes, so that the request can be sent again once all of
+// it has been read. Unlike reading it up front, this doesn't hold up
+// streaming uploads.
+type replayBody struct {
+	body  io.ReadCloser
+	max   int64
+	mutex sync.Mutex
+	buf   []byte
+	read  int64
+	// overflow is set once the body is known not to fit in max bytes,
+	// and complete once buf holds all of it
+	overflow, complete bool
+}
+
+// captureBody replaces the body of r, if it has one, with a replayBody
+// keeping up to max bytes of it.
+func captureBody(r *http.Request, max int64) *replayBody {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	if max <= 0 {
+		max = defaultRetryBodySize
+	}
+	b := &replayBody{body: r.Body, max: max, overflow: r.ContentLength > max}
+	r.Body = b
+	return b
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.read += int64(n)
+	if b.read > b.max {
+		b.overflow, b.buf = true, nil
+	}
+	if !b.overflow {
+		b.buf = append(b.buf, p[:n]...)
+		b.complete = err == io.EOF
+	}
+	return n, err
+}
+
+// Close leaves the body open, since a transport closes the body of a
+// request it couldn't send, which the next attempt then sends instead.
+// The server closes it once the handler returns.
+func (b *replayBody) Close() error {
+	return nil
+}
+
+// replay returns the body to send with the next attempt, given whether
+// the last one may have reached its server, or false if there is none.
+func (b *replayBody) replay(sent bool) (io.ReadCloser, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch {
+	case b.complete:
+		return io.NopCloser(bytes.NewReader(b.buf)), true
+	case !sent && b.read == 0:
+		// Nothing has read from it, and the failed attempt won't
+		return b, true
+	}
+	return nil, false
+}
+
+// releasingBody is a response body that calls release once it is closed,
+// so that a server counts as busy until its response has been passed on.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// releaseOnClose arranges for release to be called when the body of resp
+// is closed, or calls it now if there is no resp.
+func releaseOnClose(resp *http.Response, release func()) *http.Response {
+	if resp == nil {
+		release()
+		return nil
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp
+}
+
+// backendTransport sends a request to the backend of service picked for
+// it, then retries it on other backends as config allows. It reports
+// each attempt to the service's balancer.
+type backendTransport struct {
+	config   RetryConfig
+	budget   *retryBudget
+	service  *Service
+	backend  int
+	exclude  func(i int) bool
+	outliers *OutlierDetector
+	logger   *slog.Logger
+	// inbound is the URL the request was received for, and body its body
+	// if it has one
+	inbound   *url.URL
+	body      *replayBody
+	attempted bool
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.attempted = true
+	t.budget.deposit(t.config.Budget)
+	tried := map[int]bool{}
+	i := t.backend
+	out := req
+	for attempt := 0; ; attempt++ {
+		tried[i] = true
+		c := &ConnectionErrorHandler{
+			RoundTripper: http.DefaultTransport,
+			Logger:       *t.logger,
+			server:       t.service.Backends[i].Servers,
+			outliers:     t.outliers,
+			circuit:      t.service.circuit,
+		}
+		if t.service.circuit != nil {
+			c.breaker = t.service.breakers[i]
+		}
+		resp, err := c.RoundTrip(out)
+		backend := i
+		release := func() {
+			c.release()
+			t.service.balancer.Done(backend, c.latency, c.err)
+		}
+		if attempt >= t.config.Attempts || !t.retryable(req, resp, c.err) {
+			return releaseOnClose(resp, release), err
+		}
+		body := req.Body
+		if t.body != nil {
+			var ok bool
+			if body, ok = t.body.replay(sent(c.err)); !ok {
+				return releaseOnClose(resp, release), err
+			}
+		}
+		next := t.outliers.pick(t.service, func(j int) bool {
+			return tried[j] || t.exclude(j)
+		}, t.service.balancer.Pick)
+		if next < 0 {
+			return releaseOnClose(resp, release), err
+		}
+		if !t.budget.withdraw() {
+			t.service.balancer.Done(next, 0, nil)
+			t.logger.Warn("not retrying request, retry budget spent", "host", req.Host, "service", t.service.ID)
+			return releaseOnClose(resp, release), err
+		}
+		t.logger.Info("retrying request on another server", "host", req.Host, "service", t.service.ID,
+			"failed", t.service.Backends[i].URL, "server", t.service.Backends[next].URL)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		release()
+		i = next
+		out = req.Clone(req.Context())
+		out.URL = backendURL(t.service.Backends[i].Target, t.inbound)
+		out.Body = body
+	}
+}
+
+// sent reports whether a request that failed with err may have reached
+// its server.
+func sent(err error) bool {
+	var opErr *net.OpError
+	return !errors.Is(err, errCircuitOpen) && !(errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// retryable reports whether req, which got resp or err, can be sent to
+// another server.
+func (t *backendTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	var idempotent bool
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		idempotent = true
+	}
+	switch {
+	case !sent(err):
+		// The request never reached the server
+		return true
+	case err != nil:
+		return idempotent
+	case t.config.OnGatewayErrors && idempotent:
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryOnAnotherServer(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "live "+string(body))
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(nil)
+	dead.Close()
+
+	service, err := newService("app", Services{
+		Balancer: balancerRoundRobin,
+		Servers:  []Servers{{URL: dead.URL}, {URL: live.URL}, {URL: dead.URL + "/"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	outliers := NewOutlierDetector(OutlierConfig{}, logger)
+	budget := newRetryBudget()
+	config := RetryConfig{Attempts: 2, Budget: 20, MaxBodySize: 1024}
+
+	for n := 0; n < 6; n++ {
+		r := httptest.NewRequest("POST", "/echo", strings.NewReader("hello"))
+		i := service.balancer.Pick(nil)
+		transport := &backendTransport{
+			config:   config,
+			budget:   budget,
+			service:  service,
+			backend:  i,
+			exclude:  outliers.excluder(service.Backends),
+			outliers: outliers,
+			logger:   logger,
+			inbound:  r.URL,
+		}
+		transport.body = captureBody(r, config.MaxBodySize)
+		h := httputil.NewSingleHostReverseProxy(service.Backends[i].Target)
+		h.Transport = transport
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "live hello" {
+			t.Fatalf("request %d to backend %d: %d %q", n, i, w.Code, w.Body.String())
+		}
+	}
+
+	// Without a budget, the connection error is returned as before
+	budget.balance = 0
+	r := httptest.NewRequest("GET", "/", nil)
+	transport := &backendTransport{
+		config:   config,
+		budget:   budget,
+		service:  service,
+		backend:  0,
+		exclude:  outliers.excluder(service.Backends),
+		outliers: outliers,
+		logger:   logger,
+		inbound:  r.URL,
+	}
+	h := httputil.NewSingleHostReverseProxy(service.Backends[0].Target)
+	h.Transport = transport
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d with the retry budget spent, want 503", w.Code)
+	}
+}
+
+func TestRetryStreamsBody(t *testing.T) {
+	received := make(chan struct{}, 1)
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer busy.Close()
+	var liveRequests atomic.Int32
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		liveRequests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "live "+string(body))
+	}))
+	defer live.Close()
+
+	service, err := newService("app", Services{
+		Balancer:       balancerLeastOutstanding,
+		Servers:        []Servers{{URL: busy.URL}, {URL: live.URL}},
+		CircuitBreaker: &CircuitBreaker{MaxRequests: 1},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	outliers := NewOutlierDetector(OutlierConfig{}, logger)
+	send := func(r *http.Request) *http.Response {
+		t.Helper()
+		transport := &backendTransport{
+			config:   RetryConfig{Attempts: 1, OnGatewayErrors: true, Budget: 20},
+			budget:   newRetryBudget(),
+			service:  service,
+			backend:  service.balancer.Pick(func(i int) bool { return i != 0 }),
+			exclude:  outliers.excluder(service.Backends),
+			outliers: outliers,
+			logger:   logger,
+			inbound:  r.URL,
+			body:     captureBody(r, 1024),
+		}
+		r.URL = backendURL(service.Backends[0].Target, r.URL)
+		resp, err := transport.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	busyness := func() (int64, int) {
+		b := service.breakers[1]
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return service.balancer.(*loadBalancer).loads[1].outstanding.Load(), b.inFlight
+	}
+
+	// The rest of the body is only sent once the first server has the
+	// request, so reading it up front would never finish
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, "hel")
+		select {
+		case <-received:
+			io.WriteString(pw, "lo")
+			pw.Close()
+		case <-time.After(5 * time.Second):
+			pw.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}()
+	resp := send(httptest.NewRequest("PUT", "/echo", pr))
+	// The server stays busy until its response has been passed on
+	if outstanding, inFlight := busyness(); outstanding != 1 || inFlight != 1 {
+		t.Errorf("%d outstanding and %d in flight before the body was closed, want 1", outstanding, inFlight)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "live hello" {
+		t.Errorf("got %d %q, want the body replayed to the live server", resp.StatusCode, body)
+	}
+	if outstanding, inFlight := busyness(); outstanding != 0 || inFlight != 0 {
+		t.Errorf("%d outstanding and %d in flight after the body was closed", outstanding, inFlight)
+	}
+
+	// A body too large to keep isn't sent again
+	resp = send(httptest.NewRequest("PUT", "/echo", strings.NewReader(strings.Repeat("x", 2048))))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || liveRequests.Load() != 1 {
+		t.Errorf("got %d with %d requests to the live server, want the first server's 503", resp.StatusCode, liveRequests.Load())
+	}
+}
+
+func TestRetryKeepsEscapedPathAndTargetQuery(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.EscapedPath()+"?"+r.URL.RawQuery)
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(nil)
+	dead.Close()
+
+	service, err := newService("app", Services{
+		Servers: []Servers{{URL: dead.URL + "/base?k=v"}, {URL: live.URL + "/base?k=v"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	outliers := NewOutlierDetector(OutlierConfig{}, logger)
+	r := httptest.NewRequest("GET", "/a%2Fb?q=1", nil)
+	h := httputil.NewSingleHostReverseProxy(service.Backends[0].Target)
+	h.Transport = &backendTransport{
+		config:   RetryConfig{Attempts: 1, Budget: 20},
+		budget:   newRetryBudget(),
+		service:  service,
+		backend:  service.balancer.Pick(func(i int) bool { return i != 0 }),
+		exclude:  outliers.excluder(service.Backends),
+		outliers: outliers,
+		logger:   logger,
+		inbound:  r.URL,
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if want := "/base/a%2Fb?k=v&q=1"; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("retry got %d %q, want %q", w.Code, w.Body.String(), want)
+	}
+}
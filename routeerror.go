@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RouteError is an error routing a request, answered with Status and
+// Message. Err is the underlying cause, which is logged but not shown.
+type RouteError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *RouteError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *RouteError) Unwrap() error {
+	return e.Err
+}
+
+func unauthorized(message string, err error) *RouteError {
+	return &RouteError{http.StatusUnauthorized, message, err}
+}
+
+func forbidden(message string, err error) *RouteError {
+	return &RouteError{http.StatusForbidden, message, err}
+}
+
+func badGateway(message string, err error) *RouteError {
+	return &RouteError{http.StatusBadGateway, message, err}
+}
+
+func unavailable(message string, err error) *RouteError {
+	return &RouteError{http.StatusServiceUnavailable, message, err}
+}
+
+// errNoRouter is returned when no router matches a request.
+var errNoRouter = &RouteError{Status: http.StatusNotFound, Message: "no such deployment"}
+
+// errorTitles are the headings of the HTML error pages.
+var errorTitles = map[int]string{
+	http.StatusUnauthorized:       "Unauthorized",
+	http.StatusForbidden:          "Forbidden",
+	http.StatusNotFound:           "No Such Deployment",
+	http.StatusBadGateway:         "Bad Gateway",
+	http.StatusServiceUnavailable: "Backend Unavailable",
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>
+{{.Title}}
+</title>
+<style>
+body {
+	font-family: fantasy;
+	text-align: center;
+	padding-top: 20%;
+	background-color: #f1f6f8;
+}
+</style>
+</head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+<p>{{.Message}}.</p>
+{{- if ge .Status 500}}
+<p>If the problem persists, please get in touch.</p>
+{{- end}}
+</body>
+</html>`))
+
+// writeRouteError answers r with err, as JSON or HTML depending on what
+// the client accepts. Errors other than a RouteError are internal errors.
+func writeRouteError(w http.ResponseWriter, r *http.Request, logger *slog.Logger, err error) {
+	var e *RouteError
+	if !errors.As(err, &e) {
+		e = &RouteError{http.StatusInternalServerError, "internal error", err}
+	}
+	if e.Status >= 500 {
+		logger.Error("error routing request", "host", r.Host, "status", e.Status, "err", err)
+	} else {
+		logger.Info("refused request", "host", r.Host, "status", e.Status, "err", err)
+	}
+
+	if acceptQuality(r, "application/json") > acceptQuality(r, "text/html") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": e.Status,
+			"error":  e.Message,
+		})
+		return
+	}
+	title, ok := errorTitles[e.Status]
+	if !ok {
+		title = http.StatusText(e.Status)
+	}
+	message := e.Message
+	if message != "" {
+		message = strings.ToUpper(message[:1]) + message[1:]
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.Status)
+	errorPage.Execute(w, struct {
+		Status         int
+		Title, Message string
+	}{e.Status, title, message})
+}
+
+// acceptQuality returns the quality the Accept header of r gives to
+// mediaType, from the most specific range matching it. Without an Accept
+// header every type is acceptable.
+func acceptQuality(r *http.Request, mediaType string) float64 {
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return 1
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(strings.Join(accept, ","), ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		s := -1
+		switch t {
+		case mediaType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteRouteError(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := []struct {
+		err         error
+		accept      string
+		status      int
+		contentType string
+	}{
+		{errNoRouter, "text/html,application/xhtml+xml,*/*;q=0.8", 404, "text/html; charset=utf-8"},
+		{errNoRouter, "application/json", 404, "application/json"},
+		{unauthorized("missing X-Flakery-User-Key", nil), "", 401, "text/html; charset=utf-8"},
+		{forbidden("no private cache for this user", nil), "application/*", 403, "application/json"},
+		{badGateway("routing config unavailable", errors.New("timeout")), "text/*;q=0.5, application/json", 502, "application/json"},
+		{unavailable("no servers available", nil), "application/json;q=0.1, */*", 503, "text/html; charset=utf-8"},
+		{errors.New("boom"), "application/json", 500, "application/json"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		writeRouteError(w, r, logger, tt.err)
+		if w.Code != tt.status {
+			t.Errorf("%v: status %d, want %d", tt.err, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%v with Accept %q: content type %q, want %q", tt.err, tt.accept, got, tt.contentType)
+			continue
+		}
+		if tt.contentType == "application/json" {
+			var body struct {
+				Status int    `json:"status"`
+				Error  string `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Status != tt.status {
+				t.Errorf("%v: bad JSON body %q", tt.err, w.Body)
+			}
+			if strings.Contains(body.Error, "timeout") || strings.Contains(body.Error, "boom") {
+				t.Errorf("%v: cause leaked into body %q", tt.err, body.Error)
+			}
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Backend is a server of a service with its URL parsed ahead of time.
+type Backend struct {
+	Servers
+	Target *url.URL
+}
+
+// Service is a compiled entry of Http.Services.
+type Service struct {
+	ID       string
+	Backends []Backend
+	balancer Balancer
+	sticky   *sticky
+	circuit  *CircuitBreaker
+	breakers []*breaker
+	// state is the balancer state shared through a serverStates
+	state    balancerState
+	budget   *retryBudget
+	builtin  builtin
+	weighted []weightedService
+}
+
+// newService compiles s, apart from its references to other services,
+// with its servers' state from states, or fresh state if states is nil.
+func newService(id string, s Services, states *serverStates) (*Service, error) {
+	builtin, err := compileBuiltin(s)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", id, err)
+	}
+	svc := &Service{ID: id, Backends: make([]Backend, 0, len(s.Servers)), builtin: builtin}
+	for _, server := range s.Servers {
+		parsed, err := url.Parse(server.URL)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: error parsing server %q: %w", id, server.URL, err)
+		}
+		svc.Backends = append(svc.Backends, Backend{server, parsed})
+	}
+	svc.budget = newRetryBudget()
+	if states != nil {
+		svc.state = states.balancers.get(id, svc.Backends)
+		svc.budget = states.budgets.get(id)
+	}
+	if svc.balancer, err = newBalancer(s.Balancer, svc.Backends, svc.state); err != nil {
+		return nil, fmt.Errorf("service %s: %w", id, err)
+	}
+	if svc.sticky, err = newSticky(id, s.Sticky, svc.Backends); err != nil {
+		return nil, fmt.Errorf("service %s: %w", id, err)
+	}
+	if s.CircuitBreaker != nil {
+		svc.circuit = s.CircuitBreaker.withDefaults()
+		for _, b := range svc.Backends {
+			if states != nil {
+				svc.breakers = append(svc.breakers, states.breakers.get(id, b.URL))
+			} else {
+				svc.breakers = append(svc.breakers, &breaker{})
+			}
+		}
+	}
+	return svc, nil
+}
+
+// serverStates holds the balancer state and circuit breakers of every
+// service's servers, and each service's retry budget, so that they carry
+// over from one route table to the next. Only the tables that are served
+// are compiled with it.
+type serverStates struct {
+	balancers *balancerRegistry
+	breakers  *breakerRegistry
+	budgets   *retryBudgets
+}
+
+func newServerStates() *serverStates {
+	return &serverStates{balancers: newBalancerRegistry(), breakers: newBreakerRegistry(), budgets: newRetryBudgets()}
+}
+
+// keep drops the state of the servers that aren't in any of tables, which
+// may be nil.
+func (s *serverStates) keep(tables ...*RouteTable) {
+	next := map[string]*atomic.Uint64{}
+	loads := map[serverKey]*serverLoad{}
+	breakers := map[serverKey]*breaker{}
+	budgets := map[string]*retryBudget{}
+	for _, t := range tables {
+		if t == nil {
+			continue
+		}
+		for id, svc := range t.services {
+			if svc.state.next == nil {
+				continue
+			}
+			next[id] = svc.state.next
+			budgets[id] = svc.budget
+			for i, b := range svc.Backends {
+				loads[serverKey{id, b.URL}] = svc.state.loads[i]
+				if svc.breakers != nil {
+					breakers[serverKey{id, b.URL}] = svc.breakers[i]
+				}
+			}
+		}
+	}
+	s.balancers.mutex.Lock()
+	s.balancers.next, s.balancers.loads = next, loads
+	s.balancers.mutex.Unlock()
+	s.breakers.mutex.Lock()
+	s.breakers.breakers = breakers
+	s.breakers.mutex.Unlock()
+	s.budgets.mutex.Lock()
+	s.budgets.budgets = budgets
+	s.budgets.mutex.Unlock()
+}
+
+type weightedService struct {
+	service *Service
+	weight  int
+}
+
+// pick returns the service to handle a request: s itself, or for a
+// weighted service one of its services chosen at random by weight.
+func (s *Service) pick() *Service {
+	for len(s.weighted) > 0 {
+		total := 0
+		for _, w := range s.weighted {
+			total += w.weight
+		}
+		n := rand.IntN(total)
+		for _, w := range s.weighted {
+			if n -= w.weight; n < 0 {
+				s = w.service
+				break
+			}
+		}
+	}
+	return s
+}
+
+type route struct {
+	name     string
+	rule     rule
+	priority int
+	// rank is the precedence of the provider the router came from in a
+	// merged table, 0 being the highest.
+	rank      int
+	target    *Service
+	headers   map[string]string
+	allowHTTP bool
+	pin       *pin
+	mirror    *mirror
+}
+
+// pin is a compiled Pin.
+type pin struct {
+	header, cookie string
+	services       map[string]*Service
+}
+
+// service returns the service r is pinned to, or nil.
+func (p *pin) service(r *http.Request) *Service {
+	name := ""
+	if p.header != "" {
+		name = r.Header.Get(p.header)
+	}
+	if name == "" && p.cookie != "" {
+		if c, err := r.Cookie(p.cookie); err == nil {
+			name = c.Value
+		}
+	}
+	return p.services[name]
+}
+
+// before orders routes by decreasing priority, then by the precedence of
+// their providers and then by name so that the order is deterministic.
+func (r *route) before(o *route) bool {
+	if r.priority != o.priority {
+		return r.priority > o.priority
+	}
+	if r.rank != o.rank {
+		return r.rank < o.rank
+	}
+	return r.name < o.name
+}
+
+// RouteTable is an immutable, indexed form of a Config. It is compiled
+// once per config refresh and then shared between requests without
+// locking, so it must never be modified after compileRoutes returns.
+type RouteTable struct {
+	config  Config
+	version string
+	// Routes whose rules only match particular hosts, by host or by
+	// ".suffix" for host patterns, and the rest, each sorted with
+	// route.before.
+	routes   map[string][]*route
+	anyHost  []*route
+	services map[string]*Service
+}
+
+// compileRoutes validates c and compiles it into a RouteTable with fresh
+// server state.
+func compileRoutes(c Config) (*RouteTable, error) {
+	return compileMergedRoutes(c, nil, nil)
+}
+
+// compileMergedRoutes compiles a config merged by mergeConfigs, ranking
+// each router by the precedence of its provider and taking the state of
+// its servers from states.
+func compileMergedRoutes(c Config, ranks map[string]int, states *serverStates) (*RouteTable, error) {
+	if err := validateConfig(c); err != nil {
+		return nil, err
+	}
+	t := &RouteTable{
+		config:   c,
+		version:  configVersion(c),
+		routes:   make(map[string][]*route, len(c.Http.Routers)),
+		services: make(map[string]*Service, len(c.Http.Services)),
+	}
+	for id, s := range c.Http.Services {
+		svc, err := newService(id, s, states)
+		if err != nil {
+			return nil, err
+		}
+		t.services[id] = svc
+	}
+	for id, s := range c.Http.Services {
+		if s.Weighted == nil {
+			continue
+		}
+		for _, ref := range s.Weighted.Services {
+			if ref.Weight > 0 {
+				t.services[id].weighted = append(t.services[id].weighted, weightedService{t.services[ref.Name], ref.Weight})
+			}
+		}
+	}
+	for name, r := range c.Http.Routers {
+		ruleText := r.ruleText(name)
+		parsed, err := parseRule(ruleText)
+		if err != nil {
+			return nil, fmt.Errorf("router %s: %w", name, err)
+		}
+		rt := &route{
+			name:      name,
+			rule:      parsed,
+			priority:  r.Priority,
+			rank:      ranks[name],
+			target:    t.services[r.Service],
+			headers:   r.Headers,
+			allowHTTP: r.AllowHTTP,
+		}
+		if r.Mirror != nil {
+			rt.mirror = &mirror{
+				service:     t.services[r.Mirror.Service],
+				percent:     r.Mirror.Percent,
+				maxBodySize: r.Mirror.MaxBodySize,
+			}
+			if rt.mirror.maxBodySize == 0 {
+				rt.mirror.maxBodySize = defaultMirrorBodySize
+			}
+		}
+		if r.Pin != nil {
+			rt.pin = &pin{
+				header:   http.CanonicalHeaderKey(r.Pin.Header),
+				cookie:   r.Pin.Cookie,
+				services: map[string]*Service{},
+			}
+			for _, id := range r.Pin.Services {
+				rt.pin.services[id] = t.services[id]
+			}
+		}
+		if rt.priority == 0 {
+			rt.priority = defaultPriority(ruleText)
+		}
+		hosts := parsed.hosts()
+		if hosts == nil {
+			t.anyHost = append(t.anyHost, rt)
+		}
+		for _, host := range hosts {
+			t.routes[host] = append(t.routes[host], rt)
+		}
+	}
+	for _, routes := range t.routes {
+		sortRoutes(routes)
+	}
+	sortRoutes(t.anyHost)
+	return t, nil
+}
+
+func sortRoutes(routes []*route) {
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].before(routes[j])
+	})
+}
+
+// Config returns the configuration the table was compiled from.
+func (t *RouteTable) Config() Config {
+	return t.config
+}
+
+// Version identifies the config the table was compiled from.
+func (t *RouteTable) Version() string {
+	return t.version
+}
+
+// Match is the router a request was routed with.
+type Match struct {
+	Router  string
+	Service *Service
+	// Params are the host labels captured by the router's rule, such as
+	// name for {name}.preview.flakery.xyz.
+	Params map[string]string
+	// AllowHTTP is set if the router serves plain HTTP requests rather
+	// than redirecting them to HTTPS.
+	AllowHTTP bool
+	// Pinned is set if the request chose Service with the router's pin.
+	Pinned  bool
+	headers map[string]string
+	mirror  *mirror
+}
+
+// SetHeaders sets the router's request headers on h, replacing {param}
+// in their values with the captured host labels. An empty value removes
+// the header.
+func (m *Match) SetHeaders(h http.Header) {
+	if len(m.headers) == 0 {
+		return
+	}
+	pairs := make([]string, 0, 2*len(m.Params))
+	for k, v := range m.Params {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	expand := strings.NewReplacer(pairs...)
+	for name, value := range m.headers {
+		if value == "" {
+			h.Del(name)
+		} else {
+			h.Set(name, expand.Replace(value))
+		}
+	}
+}
+
+// Lookup returns the highest priority router whose rule matches r, which
+// is for host as returned by normalizeHost.
+func (t *RouteTable) Lookup(host string, r *http.Request) (*Match, bool) {
+	// Merge the routes for host, for each of its suffixes and for any
+	// host, in order
+	candidates := [][]*route{t.routes[host]}
+	for suffix := host; ; suffix = suffix[1:] {
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i:]
+		if routes := t.routes[suffix]; len(routes) > 0 {
+			candidates = append(candidates, routes)
+		}
+	}
+	candidates = append(candidates, t.anyHost)
+	for {
+		best := -1
+		for i, routes := range candidates {
+			if len(routes) > 0 && (best < 0 || routes[0].before(candidates[best][0])) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return nil, false
+		}
+		next := candidates[best][0]
+		candidates[best] = candidates[best][1:]
+		if next.rule.match(r, host) {
+			m := &Match{
+				Router:    next.name,
+				Service:   next.target,
+				Params:    ruleParams(next.rule, r, host),
+				AllowHTTP: next.allowHTTP,
+				headers:   next.headers,
+				mirror:    next.mirror,
+			}
+			if next.pin != nil {
+				if pinned := next.pin.service(r); pinned != nil {
+					m.Service, m.Pinned = pinned, true
+				}
+			}
+			return m, true
+		}
+	}
+}
+
+// Service returns the service with the given deployment ID.
+func (t *RouteTable) Service(id string) (*Service, bool) {
+	s, ok := t.services[id]
+	return s, ok
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWeightedServices(t *testing.T) {
+	routes, err := compileConfig([]byte(`{"http":{
+		"routers":{"app.flakery.xyz":{"service":"app"}},
+		"services":{
+			"app":{"weighted":{"services":[{"name":"stable","weight":95},{"name":"canary","weight":5},{"name":"off","weight":0}]}},
+			"stable":{"servers":[{"url":"http://s1:80","weight":3},{"url":"http://s2:80"}]},
+			"canary":{"servers":[{"url":"http://c1:80"}]},
+			"off":{"servers":[{"url":"http://off:80"}]}
+		}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, _ := routes.Service("app")
+	counts := map[string]int{}
+	const n = 20000
+	for i := 0; i < n; i++ {
+		service := app.pick()
+		i := service.balancer.Pick(nil)
+		counts[service.Backends[i].Target.Host]++
+		service.balancer.Done(i, 0, nil)
+	}
+	// Expected shares: s1 71.25%, s2 23.75%, c1 5%
+	for host, want := range map[string]float64{"s1:80": 0.7125, "s2:80": 0.2375, "c1:80": 0.05, "off:80": 0} {
+		if got := float64(counts[host]) / n; got < want-0.02 || got > want+0.02 {
+			t.Errorf("%s got %.3f of requests, want %.3f", host, got, want)
+		}
+	}
+}
+
+func TestValidateWeightedServices(t *testing.T) {
+	_, err := compileConfig([]byte(`{"http":{
+		"routers":{"a":{"service":"a"}},
+		"services":{
+			"a":{"weighted":{"services":[{"name":"b","weight":1},{"name":"missing","weight":1}]}},
+			"b":{"weighted":{"services":[{"name":"c","weight":1}]}},
+			"c":{"weighted":{"services":[{"name":"b","weight":1}]}},
+			"d":{"weighted":{"services":[{"name":"c","weight":0}]}},
+			"e":{"servers":[{"url":"http://e:80","weight":-1}]}
+		}}}`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		"service a: service missing does not exist",
+		"service b: weighted services form a cycle: b -> c -> b",
+		"service d: no service with a weight",
+		"service e: server \"http://e:80\": negative weight",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestPinnedServices(t *testing.T) {
+	routes, err := compileConfig([]byte(`{"http":{
+		"routers":{"app.flakery.xyz":{"service":"v1","pin":{"header":"x-flakery-deployment","cookie":"deployment","services":["v2"]}}},
+		"services":{
+			"v1":{"servers":[{"url":"http://v1:80"}]},
+			"v2":{"servers":[{"url":"http://v2:80"}]},
+			"internal":{"servers":[{"url":"http://internal:80"}]}
+		}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		header, cookie, want string
+	}{
+		{"", "", "v1"},
+		{"v2", "", "v2"},
+		{"", "v2", "v2"},
+		{"internal", "", "v1"},
+		{"", "internal", "v1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Flakery-Deployment", tt.header)
+		}
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "deployment", Value: tt.cookie})
+		}
+		match, _ := routes.Lookup("app.flakery.xyz", r)
+		if got := match.Service.ID; got != tt.want || match.Pinned != (tt.want != "v1") {
+			t.Errorf("header %q cookie %q: routed to %s (pinned %v), want %s", tt.header, tt.cookie, got, match.Pinned, tt.want)
+		}
+	}
+
+	_, err = compileConfig([]byte(`{"http":{
+		"routers":{"a":{"service":"a","pin":{"services":["b"]}}},
+		"services":{"a":{"servers":[{"url":"http://a:80"}]}}}}`))
+	for _, want := range []string{"pin needs a header or a cookie", "pinned service b does not exist"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v does not mention %q", err, want)
+		}
+	}
+}
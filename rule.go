@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// A rule decides whether a router handles a request. Rules are written in
+// Traefik's syntax, for example
+//
+//	Host(`example.flakery.xyz`) && (PathPrefix(`/api`) || Method(`POST`))
+//
+// with these matchers:
+//
+//	Host(`a`, ...)          the request host is one of the arguments, which
+//	                        may be patterns such as `*.flakery.xyz` or
+//	                        `{name}.preview.flakery.xyz` (see hostPattern),
+//	                        after both are normalized with normalizeHost
+//	Path(`/p`, ...)         the path is exactly one of the arguments
+//	PathPrefix(`/p`, ...)   the path starts with one of the arguments
+//	Method(`GET`, ...)      the method is one of the arguments
+//	Header(`Name`, `value`) the header has exactly this value
+//
+// Arguments may be quoted with backticks or double quotes.
+type rule interface {
+	match(r *http.Request, host string) bool
+	// hosts returns the hosts the rule can match, or nil if it isn't
+	// limited to particular hosts. A host starting with a dot stands for
+	// any host with that suffix.
+	hosts() []string
+}
+
+type andRule []rule
+
+func (a andRule) match(r *http.Request, host string) bool {
+	for _, x := range a {
+		if !x.match(r, host) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a andRule) hosts() []string {
+	for _, x := range a {
+		if hosts := x.hosts(); hosts != nil {
+			return hosts
+		}
+	}
+	return nil
+}
+
+type orRule []rule
+
+func (o orRule) match(r *http.Request, host string) bool {
+	for _, x := range o {
+		if x.match(r, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o orRule) hosts() []string {
+	var all []string
+	for _, x := range o {
+		hosts := x.hosts()
+		if hosts == nil {
+			return nil
+		}
+		all = append(all, hosts...)
+	}
+	return all
+}
+
+type notRule struct{ rule }
+
+func (n notRule) match(r *http.Request, host string) bool {
+	return !n.rule.match(r, host)
+}
+
+func (n notRule) hosts() []string {
+	return nil
+}
+
+type hostRule struct {
+	exact    []string
+	patterns []*hostPattern
+}
+
+func newHostRule(args []string) (rule, error) {
+	var h hostRule
+	for _, arg := range args {
+		arg = normalizeHost(arg)
+		if !isHostPattern(arg) {
+			h.exact = append(h.exact, arg)
+			continue
+		}
+		p, err := parseHostPattern(arg)
+		if err != nil {
+			return nil, err
+		}
+		h.patterns = append(h.patterns, p)
+	}
+	return h, nil
+}
+
+func (h hostRule) match(r *http.Request, host string) bool {
+	for _, x := range h.exact {
+		if x == host {
+			return true
+		}
+	}
+	for _, p := range h.patterns {
+		if p.re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h hostRule) hosts() []string {
+	hosts := h.exact
+	for _, p := range h.patterns {
+		if p.suffix == "" {
+			return nil
+		}
+		hosts = append(hosts, p.suffix)
+	}
+	return hosts
+}
+
+// captures returns the labels captured by the first of h's patterns that
+// matches host.
+func (h hostRule) captures(host string) map[string]string {
+	for _, p := range h.patterns {
+		if m := p.re.FindStringSubmatch(host); m != nil {
+			captures := map[string]string{}
+			for i, name := range p.re.SubexpNames() {
+				if name != "" {
+					captures[name] = m[i]
+				}
+			}
+			return captures
+		}
+	}
+	return nil
+}
+
+// ruleParams returns the host labels captured by x, which matches r for
+// host.
+func ruleParams(x rule, r *http.Request, host string) map[string]string {
+	switch x := x.(type) {
+	case hostRule:
+		return x.captures(host)
+	case andRule:
+		for _, y := range x {
+			if params := ruleParams(y, r, host); params != nil {
+				return params
+			}
+		}
+	case orRule:
+		for _, y := range x {
+			if y.match(r, host) {
+				return ruleParams(y, r, host)
+			}
+		}
+	}
+	return nil
+}
+
+// requestRule matches on anything but the host.
+type requestRule func(r *http.Request) bool
+
+func (f requestRule) match(r *http.Request, host string) bool {
+	return f(r)
+}
+
+func (f requestRule) hosts() []string {
+	return nil
+}
+
+func anyOf(args []string, f func(r *http.Request, arg string) bool) rule {
+	return requestRule(func(r *http.Request) bool {
+		for _, arg := range args {
+			if f(r, arg) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// matchers builds the rule for each matcher name from its arguments.
+var matchers = map[string]func(args []string) (rule, error){
+	"Host": newHostRule,
+	"Path": func(args []string) (rule, error) {
+		return anyOf(args, func(r *http.Request, p string) bool {
+			return r.URL.Path == p
+		}), nil
+	},
+	"PathPrefix": func(args []string) (rule, error) {
+		return anyOf(args, func(r *http.Request, p string) bool {
+			return strings.HasPrefix(r.URL.Path, p)
+		}), nil
+	},
+	"Method": func(args []string) (rule, error) {
+		return anyOf(args, func(r *http.Request, m string) bool {
+			return strings.EqualFold(r.Method, m)
+		}), nil
+	},
+	"Header": func(args []string) (rule, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("Header takes a name and a value")
+		}
+		name, value := http.CanonicalHeaderKey(args[0]), args[1]
+		return requestRule(func(r *http.Request) bool {
+			for _, v := range r.Header[name] {
+				if v == value {
+					return true
+				}
+			}
+			return false
+		}), nil
+	},
+}
+
+// parseRule parses a rule expression. && binds tighter than ||.
+func parseRule(s string) (rule, error) {
+	p := &ruleParser{s: s}
+	r, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %w", s, err)
+	}
+	p.space()
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("rule %q: unexpected %q at %d", s, p.s[p.pos:], p.pos)
+	}
+	return r, nil
+}
+
+type ruleParser struct {
+	s   string
+	pos int
+}
+
+func (p *ruleParser) space() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+// consume skips token if it comes next.
+func (p *ruleParser) consume(token string) bool {
+	p.space()
+	if strings.HasPrefix(p.s[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *ruleParser) or() (rule, error) {
+	var o orRule
+	for {
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		o = append(o, r)
+		if !p.consume("||") {
+			break
+		}
+	}
+	if len(o) == 1 {
+		return o[0], nil
+	}
+	return o, nil
+}
+
+func (p *ruleParser) and() (rule, error) {
+	var a andRule
+	for {
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, r)
+		if !p.consume("&&") {
+			break
+		}
+	}
+	if len(a) == 1 {
+		return a[0], nil
+	}
+	return a, nil
+}
+
+func (p *ruleParser) unary() (rule, error) {
+	if p.consume("!") {
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notRule{r}, nil
+	}
+	if p.consume("(") {
+		r, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, fmt.Errorf("missing ) at %d", p.pos)
+		}
+		return r, nil
+	}
+	return p.matcher()
+}
+
+func (p *ruleParser) matcher() (rule, error) {
+	p.space()
+	start := p.pos
+	for p.pos < len(p.s) && (unicode.IsLetter(rune(p.s[p.pos])) || unicode.IsDigit(rune(p.s[p.pos]))) {
+		p.pos++
+	}
+	name := p.s[start:p.pos]
+	build, ok := matchers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown matcher %q at %d", name, start)
+	}
+	if !p.consume("(") {
+		return nil, fmt.Errorf("missing ( after %s at %d", name, p.pos)
+	}
+	var args []string
+	for !p.consume(")") {
+		if len(args) > 0 && !p.consume(",") {
+			return nil, fmt.Errorf("missing , or ) at %d", p.pos)
+		}
+		arg, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s needs an argument", name)
+	}
+	r, err := build(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %w", name, start, err)
+	}
+	return r, nil
+}
+
+func (p *ruleParser) str() (string, error) {
+	p.space()
+	if p.pos == len(p.s) || (p.s[p.pos] != '`' && p.s[p.pos] != '"') {
+		return "", fmt.Errorf("expected a quoted string at %d", p.pos)
+	}
+	quote := p.s[p.pos]
+	end := strings.IndexByte(p.s[p.pos+1:], quote)
+	if end < 0 {
+		return "", fmt.Errorf("unterminated string at %d", p.pos)
+	}
+	arg := p.s[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+	return arg, nil
+}
+
+// A hostPattern matches hosts label by label. A label of * matches any
+// one label, and {name} or {name:regexp} within a label matches any text
+// without dots, or text matching regexp, capturing it as name.
+type hostPattern struct {
+	re *regexp.Regexp
+	// The labels after the last one with a wildcard, with a leading dot,
+	// or "" if the last label has a wildcard.
+	suffix string
+}
+
+// defaultPriority is the priority of a rule without an explicit one. As in
+// Traefik, longer and so more specific rules win, but wildcards don't
+// count, so that a.flakery.xyz is preferred to *.flakery.xyz and
+// {name}.preview.flakery.xyz to *.flakery.xyz.
+func defaultPriority(rule string) int {
+	n := 0
+	for i := 0; i < len(rule); i++ {
+		switch rule[i] {
+		case '*':
+		case '{':
+			if end := closingBrace(rule[i:]); end >= 0 {
+				i += end
+				continue
+			}
+			n++
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// closingBrace returns the index of the } closing the placeholder that s
+// starts with, or -1. Braces in a placeholder's regexp, as in
+// {id:[0-9]{2}}, nest.
+func closingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitLabels splits a host or host pattern into labels at the dots that
+// aren't inside a placeholder.
+func splitLabels(s string) []string {
+	var labels []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			if end := closingBrace(s[i:]); end >= 0 {
+				i += end
+			}
+		case '.':
+			labels = append(labels, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(labels, s[start:])
+}
+
+func isHostPattern(s string) bool {
+	return strings.ContainsAny(s, "*{")
+}
+
+func parseHostPattern(s string) (*hostPattern, error) {
+	labels := splitLabels(s)
+	p := &hostPattern{}
+	var re strings.Builder
+	re.WriteString("^")
+	for i, label := range labels {
+		if i > 0 {
+			re.WriteString(`\.`)
+		}
+		if label == "*" {
+			re.WriteString(`[^.]+`)
+			continue
+		}
+		for label != "" {
+			open := strings.IndexByte(label, '{')
+			if open < 0 {
+				open = len(label)
+			}
+			if strings.ContainsRune(label[:open], '*') {
+				return nil, fmt.Errorf("host pattern %q: * must be a whole label", s)
+			}
+			re.WriteString(regexp.QuoteMeta(label[:open]))
+			if open == len(label) {
+				break
+			}
+			end := closingBrace(label[open:])
+			if end < 0 {
+				return nil, fmt.Errorf("host pattern %q: missing }", s)
+			}
+			name, expr, ok := strings.Cut(label[open+1:open+end], ":")
+			if !ok {
+				expr = `[^.]+`
+			}
+			if name == "" {
+				return nil, fmt.Errorf("host pattern %q: unnamed placeholder", s)
+			}
+			fmt.Fprintf(&re, "(?P<%s>%s)", name, expr)
+			label = label[open+end+1:]
+		}
+	}
+	last := len(labels) - 1
+	for last >= 0 && !isHostPattern(labels[last]) {
+		last--
+	}
+	if last < len(labels)-1 {
+		p.suffix = "." + strings.Join(labels[last+1:], ".")
+	}
+	re.WriteString("$")
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		return nil, fmt.Errorf("host pattern %q: %w", s, err)
+	}
+	p.re = compiled
+	return p, nil
+}
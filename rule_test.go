@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	invalid := []string{
+		"",
+		"Host(`a`",
+		"Host(a)",
+		"Host()",
+		"Hots(`a`)",
+		"Host(`a`) &&",
+		"Host(`a`) PathPrefix(`/`)",
+		"Header(`X-A`)",
+		"Host(`a*.flakery.xyz`)",
+		"Host(`{name.flakery.xyz`)",
+		"Host(`{:[a-z]+}.flakery.xyz`)",
+		"Host(`{n:[a-z}.flakery.xyz`)",
+	}
+	for _, s := range invalid {
+		if _, err := parseRule(s); err == nil {
+			t.Errorf("parseRule(%q) succeeded, expected an error", s)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		rule   string
+		method string
+		host   string
+		target string
+		header [2]string
+		want   bool
+	}{
+		{"Host(`a.flakery.xyz`)", "GET", "a.flakery.xyz", "/", [2]string{}, true},
+		{"Host(`a.flakery.xyz`, `b.flakery.xyz`)", "GET", "b.flakery.xyz", "/", [2]string{}, true},
+		{"Host(`a.flakery.xyz`) && PathPrefix(`/api`)", "GET", "a.flakery.xyz", "/api/v1", [2]string{}, true},
+		{"Host(`a.flakery.xyz`) && PathPrefix(`/api`)", "GET", "a.flakery.xyz", "/", [2]string{}, false},
+		{"Host(`a.flakery.xyz`) && !Method(`POST`)", "POST", "a.flakery.xyz", "/", [2]string{}, false},
+		{"Path(`/x`) || Method(\"DELETE\")", "DELETE", "c.flakery.xyz", "/y", [2]string{}, true},
+		{"Host(`a.flakery.xyz`) && (Path(`/x`) || Header(`X-Env`, `qa`))", "GET", "a.flakery.xyz", "/", [2]string{"x-env", "qa"}, true},
+		{"Host(`a.flakery.xyz`) && (Path(`/x`) || Header(`X-Env`, `qa`))", "GET", "a.flakery.xyz", "/", [2]string{"x-env", "prod"}, false},
+	}
+	for _, tt := range tests {
+		r, err := parseRule(tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.header[0] != "" {
+			req.Header.Set(tt.header[0], tt.header[1])
+		}
+		if got := r.match(req, tt.host); got != tt.want {
+			t.Errorf("%s on %s %s%s = %v, want %v", tt.rule, tt.method, tt.host, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestLookupPriority(t *testing.T) {
+	routes, err := compileConfig([]byte(`{"http":{
+		"routers":{
+			"a.flakery.xyz":{"service":"site"},
+			"a-api":{"rule":"Host(` + "`a.flakery.xyz`" + `) && PathPrefix(` + "`/api`" + `)","service":"api"},
+			"health":{"rule":"Path(` + "`/_health`" + `)","service":"health","priority":1000}
+		},
+		"services":{
+			"site":{"servers":[{"url":"http://site:80"}]},
+			"api":{"servers":[{"url":"http://api:80"}]},
+			"health":{"servers":[{"url":"http://health:80"}]}
+		}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, target, want string
+	}{
+		{"a.flakery.xyz", "/", "site"},
+		{"a.flakery.xyz", "/api/x", "api"},
+		{"a.flakery.xyz", "/_health", "health"},
+		{"b.flakery.xyz", "/_health", "health"},
+		{"b.flakery.xyz", "/", ""},
+	}
+	for _, tt := range tests {
+		match, ok := routes.Lookup(tt.host, httptest.NewRequest("GET", tt.target, nil))
+		got := ""
+		if ok {
+			got = match.Service.ID
+		}
+		if got != tt.want {
+			t.Errorf("%s%s routed to %q, want %q", tt.host, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestLookupHostPatterns(t *testing.T) {
+	routes, err := compileConfig([]byte(`{"http":{
+		"routers":{
+			"*.flakery.xyz":{"service":"any"},
+			"api.flakery.xyz":{"service":"api"},
+			"{name}.preview.flakery.xyz":{"service":"preview","headers":{"X-Preview":"{name}","X-Drop":""}},
+			"pr":{"rule":"Host(` + "`pr-{num:[0-9]+}.flakery.xyz`" + `)","service":"pr","headers":{"X-PR":"{num}"}},
+			"{id:[0-9]{2}}.ids.flakery.xyz":{"service":"ids","headers":{"X-Id":"{id}"}},
+			"{v:v[0-9.]+}.docs.flakery.xyz":{"service":"docs","headers":{"X-Version":"{v}"}}
+		},
+		"services":{
+			"any":{"servers":[{"url":"http://any:80"}]},
+			"api":{"servers":[{"url":"http://api:80"}]},
+			"preview":{"servers":[{"url":"http://preview:80"}]},
+			"pr":{"servers":[{"url":"http://pr:80"}]},
+			"ids":{"servers":[{"url":"http://ids:80"}]},
+			"docs":{"servers":[{"url":"http://docs:80"}]}
+		}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, want, header, value string
+	}{
+		{"api.flakery.xyz", "api", "", ""},
+		{"web.flakery.xyz", "any", "", ""},
+		{"pr-12.flakery.xyz", "pr", "X-Pr", "12"},
+		{"pr-x.flakery.xyz", "any", "", ""},
+		{"feature-a.preview.flakery.xyz", "preview", "X-Preview", "feature-a"},
+		{"a.b.preview.flakery.xyz", "", "", ""},
+		{"flakery.xyz", "", "", ""},
+		{"12.ids.flakery.xyz", "ids", "X-Id", "12"},
+		{"123.ids.flakery.xyz", "", "", ""},
+		{"v1.2.docs.flakery.xyz", "docs", "X-Version", "v1.2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Drop", "1")
+		match, ok := routes.Lookup(tt.host, r)
+		got := ""
+		if ok {
+			got = match.Service.ID
+			match.SetHeaders(r.Header)
+		}
+		if got != tt.want {
+			t.Errorf("%s routed to %q, want %q", tt.host, got, tt.want)
+		}
+		if tt.header != "" && r.Header.Get(tt.header) != tt.value {
+			t.Errorf("%s: %s is %q, want %q", tt.host, tt.header, r.Header.Get(tt.header), tt.value)
+		}
+		if got == "preview" && r.Header.Get("X-Drop") != "" {
+			t.Errorf("%s: X-Drop was not removed", tt.host)
+		}
+	}
+}
+
+func TestDefaultPriorityIgnoresPlaceholders(t *testing.T) {
+	for rule, want := range map[string]string{
+		"Host(`*.flakery.xyz`)":                 "Host(`.flakery.xyz`)",
+		"Host(`{id:[0-9]{2}}.ids.flakery.xyz`)": "Host(`.ids.flakery.xyz`)",
+		"Host(`pr-{num}.flakery.xyz`)":          "Host(`pr-.flakery.xyz`)",
+	} {
+		if got := defaultPriority(rule); got != len(want) {
+			t.Errorf("defaultPriority(%s) = %d, want %d", rule, got, len(want))
+		}
+	}
+}
+
+func TestLookupNormalizedHosts(t *testing.T) {
+	routes, err := compileConfig([]byte(`{"http":{
+		"routers":{"Foo.Flakery.xyz.":{"service":"foo"}, "bücher.flakery.xyz":{"service":"books"}},
+		"services":{
+			"foo":{"servers":[{"url":"http://foo:80"}]},
+			"books":{"servers":[{"url":"http://books:80"}]}
+		}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"foo.flakery.xyz":           "foo",
+		"FOO.flakery.xyz:443":       "foo",
+		"foo.flakery.xyz.":          "foo",
+		"xn--bcher-kva.flakery.xyz": "books",
+		"Bücher.flakery.xyz":        "books",
+	} {
+		match, ok := routes.Lookup(normalizeHost(host), httptest.NewRequest("GET", "/", nil))
+		if !ok || match.Service.ID != want {
+			t.Errorf("%s did not route to %s", host, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateRewriteInterval bounds how long an unchanged config goes without
+// being rewritten to the state file.
+const stateRewriteInterval = 10 * time.Minute
+
+// persistedConfig is the on-disk form of the last good lb-config-ng. It is
+// used to route requests after a restart before the control plane is up.
+type persistedConfig struct {
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Config    json.RawMessage `json:"config"`
+}
+
+// saveState atomically replaces path with the given config: it is written
+// to a temporary file in the same directory, synced and renamed over path,
+// so a crash never leaves a truncated state file behind.
+func saveState(path string, fetchedAt time.Time, config []byte) error {
+	body, err := json.Marshal(persistedConfig{FetchedAt: fetchedAt, Config: config})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadState reads a config written by saveState, refusing it when it is
+// older than maxAge (zero means any age is acceptable).
+func loadState(path string, maxAge time.Duration) (persistedConfig, error) {
+	var s persistedConfig
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(body, &s); err != nil {
+		return s, fmt.Errorf("error parsing state file: %w", err)
+	}
+	if age := time.Since(s.FetchedAt); maxAge > 0 && age > maxAge {
+		return s, fmt.Errorf("state file is %v old, older than %v", age.Round(time.Second), maxAge)
+	}
+	return s, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	fetchedAt := time.Now().Add(-time.Hour).Round(0)
+	if err := saveState(path, fetchedAt, []byte(polledConfig)); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(path, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.FetchedAt.Equal(fetchedAt) || string(state.Config) != polledConfig {
+		t.Errorf("loaded %v %s", state.FetchedAt, state.Config)
+	}
+	if _, err := loadState(path, 30*time.Minute); err == nil {
+		t.Error("loaded a state file older than the max age")
+	}
+	if _, err := loadState(path, 0); err != nil {
+		t.Errorf("no max age: %v", err)
+	}
+
+	// The cache starts from the state file, then rewrites it when an
+	// unchanged config hasn't been saved for a while
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, polledConfig)
+	}))
+	defer srv.Close()
+	c := NewTTLCache(srv.URL, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := c.UseStateFile(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if host := backendHost(t, c); host != "polled:8080" {
+		t.Fatalf("seeded config routed to %s", host)
+	}
+	c.mutex.Lock()
+	_, err = c.fetch()
+	c.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := loadState(path, 0); time.Since(state.FetchedAt) > time.Minute {
+		t.Errorf("unchanged config last saved %v ago", time.Since(state.FetchedAt))
+	}
+
+	// So does a config confirmed with 304 Not Modified
+	if err := saveState(path, fetchedAt, []byte(polledConfig)); err != nil {
+		t.Fatal(err)
+	}
+	c.mutex.Lock()
+	c.savedAt = fetchedAt
+	routes := c.routes.Load()
+	fetched, err := c.fetch()
+	c.mutex.Unlock()
+	if err != nil || fetched != routes {
+		t.Fatalf("304 gave %p (%v), want the current table %p", fetched, err, routes)
+	}
+	if state, err := loadState(path, 0); err != nil || time.Since(state.FetchedAt) > time.Minute || string(state.Config) != polledConfig {
+		t.Errorf("config confirmed by 304 last saved %v ago (%v)", time.Since(state.FetchedAt), err)
+	}
+}
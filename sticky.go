@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// stickySecret signs affinity cookies. Proxies sharing clients must share
+// it, through STICKY_COOKIE_SECRET; without it cookies only last as long
+// as the process.
+var stickySecret = func() []byte {
+	if s := os.Getenv("STICKY_COOKIE_SECRET"); s != "" {
+		return []byte(s)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// sticky is a compiled Sticky.
+type sticky struct {
+	cookie string
+	// tokens are the cookie values naming each backend
+	tokens []string
+	// hashKey returns what to hash r on, or "" if there is nothing to
+	hashKey func(r *http.Request) string
+}
+
+func newSticky(id string, s *Sticky, backends []Backend) (*sticky, error) {
+	if s == nil {
+		return nil, nil
+	}
+	st := &sticky{cookie: s.Cookie}
+	if s.Hash != "" {
+		var err error
+		if st.hashKey, err = stickyHashKey(s.Hash); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range backends {
+		// The cookie is a MAC of the server rather than the server
+		// itself, so that clients can't pick servers or learn their
+		// addresses
+		mac := hmac.New(sha256.New, stickySecret)
+		mac.Write([]byte(id + "\x00" + b.URL))
+		st.tokens = append(st.tokens, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16]))
+	}
+	return st, nil
+}
+
+// validateSticky checks s without compiling it.
+func validateSticky(s *Sticky) error {
+	if (s.Cookie == "") == (s.Hash == "") {
+		return fmt.Errorf("sticky needs either a cookie or a hash")
+	}
+	if s.Hash != "" {
+		if _, err := stickyHashKey(s.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stickyHashKey parses a Sticky.Hash: "ip", "header:<name>", or "jwt" or
+// "jwt:<header>" for the user ID in a JWT given in a header (by default
+// Authorization).
+func stickyHashKey(hash string) (func(r *http.Request) string, error) {
+	kind, arg, _ := strings.Cut(hash, ":")
+	switch {
+	case kind == "ip" && arg == "":
+		return func(r *http.Request) string {
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				return host
+			}
+			return r.RemoteAddr
+		}, nil
+	case kind == "header" && arg != "":
+		return func(r *http.Request) string {
+			return r.Header.Get(arg)
+		}, nil
+	case kind == "jwt":
+		if arg == "" {
+			arg = "Authorization"
+		}
+		return func(r *http.Request) string {
+			return jwtUserID(r.Header.Get(arg))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown sticky hash %q", hash)
+}
+
+// jwtUserID returns the user in token, which may follow "Bearer ". The
+// token isn't verified, since the user ID only picks a server.
+func jwtUserID(token string) string {
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = token[7:]
+	}
+	if token == "" {
+		return ""
+	}
+	var claims MyCustomClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return ""
+	}
+	if claims.UserID != "" {
+		return claims.UserID
+	}
+	return claims.Subject
+}
+
+// pickBackend returns the index of the backend of s to send r to, or -1,
+// along with a cookie to set if r is to stick to it. A request sticks to
+// the backend named by its cookie or chosen by its hash unless exclude
+// rules it out, in which case the balancer picks another.
+func (s *Service) pickBackend(r *http.Request, exclude func(i int) bool) (int, *http.Cookie) {
+	st := s.sticky
+	if st == nil {
+		return s.balancer.Pick(exclude), nil
+	}
+	preferred := -1
+	if st.cookie != "" {
+		if c, err := r.Cookie(st.cookie); err == nil {
+			for i, token := range st.tokens {
+				if hmac.Equal([]byte(c.Value), []byte(token)) {
+					preferred = i
+					break
+				}
+			}
+		}
+	} else if key := st.hashKey(r); key != "" {
+		preferred = rendezvous(key, s.Backends, exclude)
+	}
+	if preferred >= 0 && (exclude == nil || !exclude(preferred)) {
+		// Go through the balancer so that it counts the request
+		if i := s.balancer.Pick(func(i int) bool { return i != preferred }); i >= 0 {
+			return i, nil
+		}
+	}
+	i := s.balancer.Pick(exclude)
+	if i < 0 || st.cookie == "" {
+		return i, nil
+	}
+	return i, &http.Cookie{
+		Name:     st.cookie,
+		Value:    st.tokens[i],
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// rendezvous returns the backend with the highest weighted rendezvous
+// hash score for key that isn't excluded or drained, or -1. Adding or
+// removing a backend only moves the keys that it scores highest for.
+func rendezvous(key string, backends []Backend, exclude func(i int) bool) int {
+	best, bestScore := -1, math.Inf(-1)
+	for i, b := range backends {
+		if b.weight() == 0 || (exclude != nil && exclude(i)) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key + "\x00" + b.URL))
+		// A uniform number in (0, 1) from the hash, mixed since FNV's
+		// high bits are weak
+		x := h.Sum64()
+		x ^= x >> 33
+		x *= 0xff51afd7ed558ccd
+		x ^= x >> 33
+		u := (float64(x>>11) + 0.5) / (1 << 53)
+		if score := -float64(b.weight()) / math.Log(u); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
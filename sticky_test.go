@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStickyCookie(t *testing.T) {
+	service, err := newService("app", Services{
+		Servers: []Servers{{URL: "http://a"}, {URL: "http://b"}, {URL: "http://c"}},
+		Sticky:  &Sticky{Cookie: "app-affinity"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, cookie := service.pickBackend(httptest.NewRequest("GET", "/", nil), nil)
+	service.balancer.Done(i, 0, nil)
+	if cookie == nil {
+		t.Fatal("no affinity cookie set")
+	}
+	for n := 0; n < 10; n++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		j, again := service.pickBackend(r, nil)
+		service.balancer.Done(j, 0, nil)
+		if j != i || again != nil {
+			t.Fatalf("request with cookie went to %d (cookie %v), want %d", j, again, i)
+		}
+	}
+
+	// Fall back to another server when the pinned one is unhealthy
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	j, moved := service.pickBackend(r, func(k int) bool { return k == i })
+	if j == i || j < 0 || moved == nil || moved.Value == cookie.Value {
+		t.Errorf("got backend %d and cookie %v with backend %d excluded", j, moved, i)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "app-affinity", Value: "http://a"})
+	if _, forged := service.pickBackend(r, nil); forged == nil {
+		t.Error("accepted a forged cookie")
+	}
+}
+
+func TestRendezvousMovesFewKeys(t *testing.T) {
+	backends := []Backend{}
+	for n := 0; n < 5; n++ {
+		backends = append(backends, Backend{Servers: Servers{URL: fmt.Sprintf("http://10.0.0.%d", n)}})
+	}
+	before := map[string]string{}
+	for n := 0; n < 1000; n++ {
+		key := fmt.Sprint("user", n)
+		before[key] = backends[rendezvous(key, backends, nil)].URL
+	}
+	// Removing a server only moves its own keys
+	removed := backends[2].URL
+	moved := 0
+	for key, url := range before {
+		got := backends[rendezvous(key, backends, func(i int) bool { return i == 2 })].URL
+		if url != removed && got != url {
+			t.Fatalf("%s moved from %s to %s", key, url, got)
+		}
+		if got != url {
+			moved++
+		}
+	}
+	if moved < 100 || moved > 300 {
+		t.Errorf("%d of 1000 keys moved, want about 200", moved)
+	}
+}
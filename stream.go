@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ConfigStream subscribes to the control plane's server-sent events
+// endpoint and pushes every config it receives into a TTLCache. Each event
+// carries a complete lb-config-ng document; comment lines are heartbeats.
+//
+// While the stream is connected the cache stops polling. When it drops,
+// polling resumes until the stream is re-established.
+type ConfigStream struct {
+	URL         string
+	Cache       *TTLCache
+	Logger      *slog.Logger
+	IdleTimeout time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+func NewConfigStream(url string, cache *TTLCache, logger *slog.Logger) *ConfigStream {
+	return &ConfigStream{
+		URL:         url,
+		Cache:       cache,
+		Logger:      logger,
+		IdleTimeout: time.Minute,
+		MinBackoff:  time.Second,
+		MaxBackoff:  30 * time.Second,
+	}
+}
+
+// Run keeps the stream connected until ctx is cancelled.
+func (s *ConfigStream) Run(ctx context.Context) {
+	backoff := s.MinBackoff
+	for {
+		start := time.Now()
+		err := s.subscribe(ctx)
+		s.Cache.streaming.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > s.MaxBackoff {
+			backoff = s.MinBackoff
+		}
+		s.Logger.Warn("config stream dropped, falling back to polling", "err", err, "retry", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.MaxBackoff)
+	}
+}
+
+func (s *ConfigStream) subscribe(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stream request failed with status code %d", resp.StatusCode)
+	}
+	s.Logger.Info("config stream connected", "url", s.URL)
+
+	// A connection that silently stops delivering heartbeats is dropped,
+	// so that polling takes over.
+	idle := time.AfterFunc(s.IdleTimeout, cancel)
+	defer idle.Stop()
+
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		idle.Reset(s.IdleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line dispatches the event
+			if len(data) == 0 {
+				continue
+			}
+			body := strings.Join(data, "\n")
+			data = data[:0]
+			if err := s.Cache.Push([]byte(body)); err != nil {
+				s.Logger.Error("error applying streamed config", "err", err)
+				continue
+			}
+			s.Cache.streaming.Store(true)
+		case strings.HasPrefix(line, ":"):
+			// heartbeat
+		case line == "data" || strings.HasPrefix(line, "data:"):
+			value := strings.TrimPrefix(strings.TrimPrefix(line, "data"), ":")
+			data = append(data, strings.TrimPrefix(value, " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by server")
+}
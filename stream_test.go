@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	polledConfig   = `{"http":{"routers":{"a.flakery.xyz":{"service":"a"}},"services":{"a":{"servers":[{"url":"http://polled:8080"}]}}}}`
+	streamedConfig = `{"http":{"routers":{"a.flakery.xyz":{"service":"a"}},"services":{"a":{"servers":[{"url":"http://streamed:8080"}]}}}}`
+)
+
+// fakeControlPlane serves polledConfig on the polling endpoint and, for
+// each subscriber, streams streamedConfig and holds the stream open until
+// a value is sent on drop.
+func fakeControlPlane(t *testing.T, drop chan struct{}) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/deployments/lb-config-ng", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, polledConfig)
+	})
+	mux.HandleFunc("/api/deployments/lb-config-ng/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, ": hello\n\ndata: %s\n\n", streamedConfig)
+		w.(http.Flusher).Flush()
+		select {
+		case <-drop:
+		case <-r.Context().Done():
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func backendHost(t *testing.T, c *TTLCache) string {
+	t.Helper()
+	routes := firstRoutes(t, c)
+	match, _ := routes.Lookup("a.flakery.xyz", httptest.NewRequest("GET", "/", nil))
+	return match.Service.Backends[0].Target.Host
+}
+
+// firstRoutes waits for c to fetch a table in the background.
+func firstRoutes(t *testing.T, c *TTLCache) *RouteTable {
+	t.Helper()
+	var routes *RouteTable
+	waitFor(t, "the first config", func() bool {
+		routes, _ = c.Routes()
+		return routes != nil
+	})
+	return routes
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConfigStreamFallsBackToPolling(t *testing.T) {
+	drop := make(chan struct{})
+	srv := fakeControlPlane(t, drop)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cache := NewTTLCache(srv.URL+"/api/deployments/lb-config-ng", 10*time.Millisecond, logger)
+	stream := NewConfigStream(srv.URL+"/api/deployments/lb-config-ng/stream", cache, logger)
+	stream.MinBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go stream.Run(ctx)
+
+	waitFor(t, "streamed config", func() bool { return cache.Status().Streaming })
+	if got := backendHost(t, cache); got != "streamed:8080" {
+		t.Fatalf("got backend %q, want the streamed config", got)
+	}
+
+	// Polling is suspended while the stream is up
+	time.Sleep(50 * time.Millisecond)
+	if got := backendHost(t, cache); got != "streamed:8080" {
+		t.Fatalf("got backend %q while streaming, want the streamed config", got)
+	}
+
+	close(drop)
+	waitFor(t, "stream to drop", func() bool { return !cache.Status().Streaming })
+	waitFor(t, "polled config", func() bool { return backendHost(t, cache) == "polled:8080" })
+}
+
+func TestConfigStreamIdleTimeout(t *testing.T) {
+	srv := fakeControlPlane(t, make(chan struct{}))
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cache := NewTTLCache(srv.URL+"/api/deployments/lb-config-ng", time.Hour, logger)
+	stream := NewConfigStream(srv.URL+"/api/deployments/lb-config-ng/stream", cache, logger)
+	stream.IdleTimeout = 50 * time.Millisecond
+
+	err := stream.subscribe(context.Background())
+	if err == nil {
+		t.Fatal("expected a stream without heartbeats to be dropped")
+	}
+	if cache.Status().FetchedAt.IsZero() {
+		t.Fatal("expected the streamed config to have been applied")
+	}
+}
@@ -1,64 +1,296 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// TTLCache holds the route table compiled from the control plane's
+// lb-config-ng. It never blocks a request on the control plane: fetches
+// happen in the background, an expired table keeps being served while a
+// single refresh replaces it, and a failed refresh leaves the last good
+// table in place.
 type TTLCache struct {
-	cache     []byte
-	expiresAt time.Time
-	ttl       time.Duration
-	mutex     sync.Mutex
+	url        string
+	routes     atomic.Pointer[RouteTable]
+	expiresAt  atomic.Int64
+	refreshing atomic.Bool
+	streaming  atomic.Bool
+	ttl        time.Duration
+	mutex      sync.Mutex
+	client     *http.Client
+	logger     *slog.Logger
+	statePath  string
+	savedAt    time.Time
+
+	// Validators of the current config, sent so that the control plane
+	// can answer 304 Not Modified
+	etag         string
+	lastModified string
+	hash         [sha256.Size]byte
+	// body is the current config as fetched, to be saved again when the
+	// control plane confirms it is unchanged
+	body []byte
+
+	statusMutex sync.Mutex
+	fetchedAt   time.Time
+	lastErr     error
+	failures    int
 }
 
-func NewTTLCache(defaultTTL time.Duration) *TTLCache {
-	return &TTLCache{
-		cache:     nil,
-		expiresAt: time.Now(),
-		ttl:       defaultTTL,
+// CacheStatus describes how current the cached config is.
+type CacheStatus struct {
+	FetchedAt  time.Time `json:"fetchedAt"`
+	AgeSeconds float64   `json:"ageSeconds"`
+	Stale      bool      `json:"stale"`
+	Refreshing bool      `json:"refreshing"`
+	Streaming  bool      `json:"streaming"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+func NewTTLCache(url string, defaultTTL time.Duration, logger *slog.Logger) *TTLCache {
+	c := &TTLCache{
+		url:    url,
+		ttl:    defaultTTL,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+	}
+	c.expiresAt.Store(time.Now().UnixNano())
+	return c
+}
+
+// Routes returns the compiled route table, or an error if none has been
+// fetched yet. An expired or missing table triggers a background refresh.
+// No refreshes happen while a ConfigStream is delivering updates.
+func (c *TTLCache) Routes() (*RouteTable, error) {
+	c.revalidate()
+	if routes := c.routes.Load(); routes != nil {
+		return routes, nil
+	}
+
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+	if c.lastErr != nil {
+		return nil, fmt.Errorf("no config fetched yet: %w", c.lastErr)
 	}
+	return nil, fmt.Errorf("no config fetched yet")
 }
 
-func (c *TTLCache) Get() ([]byte, error) {
+// revalidate starts a background refresh if the table has expired and
+// none is running already.
+func (c *TTLCache) revalidate() {
+	if !c.streaming.Load() && time.Now().UnixNano() >= c.expiresAt.Load() && c.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer c.refreshing.Store(false)
+			c.refresh()
+		}()
+	}
+}
+
+func (c *TTLCache) refresh() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if c.cache == nil || time.Now().After(c.expiresAt) {
-		// Cache entry has expired, perform a GET request to refresh the value
-		value, err := c.performGetRequest()
-		if err != nil {
+	_, err := c.fetch()
+	switch {
+	case err == nil:
+	case c.routes.Load() == nil:
+		c.logger.Warn("config fetch failed, no config to serve yet", "err", err)
+	default:
+		c.logger.Warn("config refresh failed, serving stale config", "err", err, "age", c.Status().AgeSeconds)
+	}
+}
+
+// fetch must be called with c.mutex held.
+func (c *TTLCache) fetch() (*RouteTable, error) {
+	resp, err := c.performGetRequest()
+	if err != nil {
+		c.setStatus(err)
+		return nil, err
+	}
+	if resp.notModified {
+		return c.apply(c.body)
+	}
+	c.etag = resp.etag
+	c.lastModified = resp.lastModified
+	return c.apply(resp.body)
+}
+
+// Push replaces the config with one delivered by the control plane rather
+// than polled from it.
+func (c *TTLCache) Push(body []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// The validators no longer describe the config being served
+	c.etag = ""
+	c.lastModified = ""
+	_, err := c.apply(body)
+	return err
+}
+
+// apply must be called with c.mutex held.
+func (c *TTLCache) apply(body []byte) (*RouteTable, error) {
+	routes := c.routes.Load()
+	// An unchanged body is common when the control plane doesn't support
+	// conditional requests, and needs no recompiling
+	hash := sha256.Sum256(body)
+	changed := routes == nil || hash != c.hash
+	if changed {
+		var err error
+		if routes, err = compileConfig(body); err != nil {
+			c.setStatus(err)
 			return nil, err
 		}
+		c.hash = hash
+		c.body = body
+		c.routes.Store(routes)
+	}
+	c.setStatus(nil)
+
+	// Also rewrite an unchanged config now and then, so that its age in
+	// the state file reflects when it was last confirmed
+	if c.statePath != "" && (changed || time.Since(c.savedAt) > stateRewriteInterval) {
+		now := time.Now()
+		if err := saveState(c.statePath, now, body); err != nil {
+			c.logger.Warn("error saving config state", "err", err, "path", c.statePath)
+		} else {
+			c.savedAt = now
+		}
+	}
+	return routes, nil
+}
+
+func (c *TTLCache) setStatus(err error) {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	// Back off after a failure, starting at a second and never waiting
+	// longer than the TTL, so an unavailable control plane isn't hit by
+	// every request
+	next := c.ttl
+	if err != nil {
+		next = min(time.Second<<min(c.failures, 16), c.ttl)
+		c.failures++
+	} else {
+		c.failures = 0
+	}
+	c.expiresAt.Store(time.Now().Add(next).UnixNano())
+	c.lastErr = err
+	if err == nil {
+		c.fetchedAt = time.Now()
+	}
+}
 
-		// Update the cache entry with the new value and expiration time
-		c.cache = value
-		c.expiresAt = time.Now().Add(c.ttl)
+func compileConfig(value []byte) (*RouteTable, error) {
+	config, err := parseConfig(value)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config: %w", err)
 	}
+	routes, err := compileRoutes(config)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling config: %w", err)
+	}
+	return routes, nil
+}
 
-	return c.cache, nil
+// UseStateFile makes the cache persist every new config to path and seeds
+// it with the config already stored there, if that is no older than
+// maxAge. The seeded config counts as expired, so it is still refreshed
+// from the control plane straight away.
+func (c *TTLCache) UseStateFile(path string, maxAge time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.statePath = path
+	state, err := loadState(path, maxAge)
+	if err != nil {
+		return err
+	}
+	routes, err := compileConfig(state.Config)
+	if err != nil {
+		return err
+	}
+
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+	c.fetchedAt = state.FetchedAt
+	c.savedAt = state.FetchedAt
+	c.hash = sha256.Sum256(state.Config)
+	c.body = state.Config
+	c.routes.Store(routes)
+	return nil
 }
 
-func (c *TTLCache) performGetRequest() ([]byte, error) {
-	baseUrl := "http://localhost:3000"
-	if os.Getenv("FLAKERY_BASE_URL") != "" {
-		baseUrl = os.Getenv("FLAKERY_BASE_URL")
+// Status reports when the current config was fetched and whether the
+// last refresh failed.
+func (c *TTLCache) Status() CacheStatus {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	s := CacheStatus{
+		FetchedAt:  c.fetchedAt,
+		Stale:      c.routes.Load() == nil || c.lastErr != nil,
+		Refreshing: c.refreshing.Load(),
+		Streaming:  c.streaming.Load(),
 	}
-	resp, err := http.Get(baseUrl + "/api/deployments/lb-config-ng")
+	if !c.fetchedAt.IsZero() {
+		s.AgeSeconds = time.Since(c.fetchedAt).Seconds()
+	}
+	if c.lastErr != nil {
+		s.LastError = c.lastErr.Error()
+	}
+	return s
+}
+
+type configResponse struct {
+	body         []byte
+	notModified  bool
+	etag         string
+	lastModified string
+}
+
+// performGetRequest must be called with c.mutex held.
+func (c *TTLCache) performGetRequest() (configResponse, error) {
+	req, err := http.NewRequest("GET", c.url, nil)
 	if err != nil {
-		return nil, err
+		return configResponse{}, err
+	}
+	if c.routes.Load() != nil {
+		if c.etag != "" {
+			req.Header.Set("If-None-Match", c.etag)
+		}
+		if c.lastModified != "" {
+			req.Header.Set("If-Modified-Since", c.lastModified)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return configResponse{}, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return configResponse{notModified: true}, nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GET request failed with status code %d", resp.StatusCode)
+		return configResponse{}, fmt.Errorf("GET request failed with status code %d", resp.StatusCode)
 	}
 
 	// Read the response body
-	return io.ReadAll(resp.Body)
-
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return configResponse{}, err
+	}
+	return configResponse{
+		body:         body,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// switchableControlPlane serves body, or fails while status is set.
+type switchableControlPlane struct {
+	mutex  sync.Mutex
+	body   string
+	status int
+}
+
+func (p *switchableControlPlane) set(body string, status int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.body, p.status = body, status
+}
+
+func (p *switchableControlPlane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.status != 0 {
+		w.WriteHeader(p.status)
+		return
+	}
+	io.WriteString(w, p.body)
+}
+
+func TestTTLCacheServesStaleWhileRevalidating(t *testing.T) {
+	plane := &switchableControlPlane{body: polledConfig}
+	srv := httptest.NewServer(plane)
+	defer srv.Close()
+	c := NewTTLCache(srv.URL, 20*time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	if host := backendHost(t, c); host != "polled:8080" {
+		t.Fatalf("first fetch routed to %s", host)
+	}
+
+	// A failed refresh keeps the last good config
+	plane.set("", http.StatusInternalServerError)
+	time.Sleep(30 * time.Millisecond)
+	if host := backendHost(t, c); host != "polled:8080" {
+		t.Fatalf("expired config routed to %s", host)
+	}
+	waitFor(t, "the failed refresh", func() bool { return c.Status().LastError != "" })
+	if status := c.Status(); !status.Stale || !strings.Contains(status.LastError, "500") {
+		t.Errorf("status after a failed refresh: %+v", status)
+	}
+	if host := backendHost(t, c); host != "polled:8080" {
+		t.Fatalf("config after a failed refresh routed to %s", host)
+	}
+
+	// A later refresh replaces it in the background
+	plane.set(streamedConfig, 0)
+	waitFor(t, "the new config", func() bool { return backendHost(t, c) == "streamed:8080" })
+	if status := c.Status(); status.Stale || status.LastError != "" {
+		t.Errorf("status after a good refresh: %+v", status)
+	}
+}
+
+func TestTTLCacheColdStart(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		fetches int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fetches++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	c := NewTTLCache(srv.URL, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// Requests don't wait for the control plane, and a failed fetch isn't
+	// retried by every request that follows
+	if _, err := c.Routes(); err == nil {
+		t.Fatal("got routes before any were fetched")
+	}
+	waitFor(t, "the failed fetch", func() bool { return c.Status().LastError != "" })
+	for range 10 {
+		if _, err := c.Routes(); err == nil || !strings.Contains(err.Error(), "502") {
+			t.Fatalf("got error %v, want the failed fetch", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fetches != 1 {
+		t.Errorf("%d fetches, want one until the backoff expires", fetches)
+	}
+}
+
+func TestTTLCacheConditionalFetch(t *testing.T) {
+	var (
+		mutex       sync.Mutex
+		notModified int
+		etag        = `"v1"`
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if etag != "" && r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		io.WriteString(w, polledConfig)
+	}))
+	defer srv.Close()
+	c := NewTTLCache(srv.URL, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	first := firstRoutes(t, c)
+	c.mutex.Lock()
+	again, err := c.fetch()
+	c.mutex.Unlock()
+	if err != nil || again != first || notModified != 1 {
+		t.Fatalf("refetch got %p (%v) after %d 304s, want the same table %p after one", again, err, notModified, first)
+	}
+
+	// Without validators an unchanged body isn't recompiled either
+	mutex.Lock()
+	etag = ""
+	mutex.Unlock()
+	c.mutex.Lock()
+	again, err = c.fetch()
+	c.mutex.Unlock()
+	if err != nil || again != first {
+		t.Errorf("unchanged body got table %p (%v), want %p", again, err, first)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// validateConfig reports every problem with c that would otherwise only
+// show up when a request is routed with it.
+func validateConfig(c Config) error {
+	var errs []error
+	// Routers named by their host, by normalized host
+	hosts := map[string]string{}
+	for _, name := range sortedKeys(c.Http.Routers) {
+		r := c.Http.Routers[name]
+		if name == "" && r.Rule == "" {
+			errs = append(errs, fmt.Errorf("router with an empty host and no rule"))
+		}
+		if r.Rule == "" {
+			host := normalizeHost(name)
+			if other, ok := hosts[host]; ok {
+				errs = append(errs, fmt.Errorf("routers %s and %s are both for host %s", other, name, host))
+			}
+			hosts[host] = name
+		}
+		if _, err := parseRule(r.ruleText(name)); err != nil {
+			errs = append(errs, fmt.Errorf("router %s: %w", name, err))
+		}
+		if m := r.Mirror; m != nil {
+			if s, ok := c.Http.Services[m.Service]; !ok {
+				errs = append(errs, fmt.Errorf("router %s: mirror service %s does not exist", name, m.Service))
+			} else if s.Type != "" {
+				errs = append(errs, fmt.Errorf("router %s: can't mirror to built-in service %s", name, m.Service))
+			}
+			if m.Percent < 0 || m.Percent > 100 {
+				errs = append(errs, fmt.Errorf("router %s: mirror percent must be between 0 and 100", name))
+			}
+			if m.MaxBodySize < 0 {
+				errs = append(errs, fmt.Errorf("router %s: negative mirror maxBodySize", name))
+			}
+		}
+		if r.Pin != nil {
+			if r.Pin.Header == "" && r.Pin.Cookie == "" {
+				errs = append(errs, fmt.Errorf("router %s: pin needs a header or a cookie", name))
+			}
+			for _, id := range r.Pin.Services {
+				if _, ok := c.Http.Services[id]; !ok {
+					errs = append(errs, fmt.Errorf("router %s: pinned service %s does not exist", name, id))
+				}
+			}
+		}
+		if r.Service == "" {
+			errs = append(errs, fmt.Errorf("router %s: no service", name))
+		} else if _, ok := c.Http.Services[r.Service]; !ok {
+			errs = append(errs, fmt.Errorf("router %s: service %s does not exist", name, r.Service))
+		}
+	}
+	for _, id := range sortedKeys(c.Http.Services) {
+		s := c.Http.Services[id]
+		switch {
+		case s.Type != "" && s.Weighted != nil:
+			errs = append(errs, fmt.Errorf("service %s: a built-in service can't be weighted", id))
+		case s.Type != "":
+			if err := validateBuiltin(s); err != nil {
+				errs = append(errs, fmt.Errorf("service %s: %w", id, err))
+			}
+		case s.Weighted != nil:
+			if err := validateWeighted(c.Http.Services, id); err != nil {
+				errs = append(errs, fmt.Errorf("service %s: %w", id, err))
+			}
+		case len(s.Servers) == 0:
+			errs = append(errs, fmt.Errorf("service %s: no servers", id))
+		}
+		if _, err := newBalancer(s.Balancer, nil, balancerState{}); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %w", id, err))
+		}
+		if len(s.Servers) > 0 && (s.Type != "" || s.Weighted != nil) {
+			errs = append(errs, fmt.Errorf("service %s: servers are only used by services without a type or weights", id))
+		}
+		if s.CircuitBreaker != nil {
+			if s.Type != "" || s.Weighted != nil {
+				errs = append(errs, fmt.Errorf("service %s: only services with servers can have a circuit breaker", id))
+			} else if err := validateCircuitBreaker(s.CircuitBreaker); err != nil {
+				errs = append(errs, fmt.Errorf("service %s: %w", id, err))
+			}
+		}
+		if s.Sticky != nil {
+			if s.Type != "" || s.Weighted != nil {
+				errs = append(errs, fmt.Errorf("service %s: only services with servers can be sticky", id))
+			} else if err := validateSticky(s.Sticky); err != nil {
+				errs = append(errs, fmt.Errorf("service %s: %w", id, err))
+			}
+		}
+		total := 0
+		for _, server := range s.Servers {
+			if err := validateServerURL(server.URL); err != nil {
+				errs = append(errs, fmt.Errorf("service %s: %w", id, err))
+			}
+			if server.weight() < 0 {
+				errs = append(errs, fmt.Errorf("service %s: server %q: negative weight", id, server.URL))
+			}
+			total += max(server.weight(), 0)
+		}
+		if len(s.Servers) > 0 && total == 0 {
+			errs = append(errs, fmt.Errorf("service %s: no server with a weight", id))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateWeighted checks that the weighted service id refers to existing
+// services, with weights that aren't all zero, and doesn't refer back to
+// itself through them.
+func validateWeighted(services map[string]Services, id string) error {
+	total := 0
+	for _, ref := range services[id].Weighted.Services {
+		if _, ok := services[ref.Name]; !ok {
+			return fmt.Errorf("service %s does not exist", ref.Name)
+		}
+		if ref.Weight < 0 {
+			return fmt.Errorf("service %s: negative weight", ref.Name)
+		}
+		total += ref.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("no service with a weight")
+	}
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		s, ok := services[name]
+		if !ok || s.Weighted == nil {
+			return nil
+		}
+		for _, seen := range path {
+			if seen == name {
+				return fmt.Errorf("weighted services form a cycle: %s", strings.Join(append(path, name), " -> "))
+			}
+		}
+		for _, ref := range s.Weighted.Services {
+			if err := visit(ref.Name, append(path, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return visit(id, nil)
+}
+
+func validateServerURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("server %q: %w", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("server %q: scheme must be http or https", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("server %q: no host", s)
+	}
+	return nil
+}
+
+// checkDuplicateKeys fails if any JSON object in body has the same key
+// twice, which encoding/json silently resolves by keeping the last one.
+func checkDuplicateKeys(body []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var check func(path string) error
+	check = func(path string) error {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'):
+			seen := map[string]bool{}
+			for dec.More() {
+				t, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := t.(string)
+				if seen[key] {
+					return fmt.Errorf("%s: %q is defined more than once", path, key)
+				}
+				seen[key] = true
+				if err := check(path + "." + key); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := check(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+		return nil
+	}
+	return check("$")
+}
+
+// checkConfig implements the check-config subcommand, validating a config
+// file or directory as the file provider would load it, or a JSON config
+// read from stdin if path is "-".
+func checkConfig(path string, stdin io.Reader, stdout io.Writer) error {
+	var (
+		config Config
+		err    error
+	)
+	if path == "-" {
+		var body []byte
+		if body, err = io.ReadAll(stdin); err == nil {
+			config, err = parseConfig(body)
+		}
+	} else {
+		config, err = loadConfigPath(path)
+	}
+	if err != nil {
+		return err
+	}
+	if err := validateConfig(config); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s: ok, %d routers, %d services\n", path, len(config.Http.Routers), len(config.Http.Services))
+	return nil
+}
+
+func checkConfigMain(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s check-config <file|dir|->\n", os.Args[0])
+		os.Exit(2)
+	}
+	if err := checkConfig(args[0], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid config:\n  %s\n", args[0], strings.ReplaceAll(err.Error(), "\n", "\n  "))
+		os.Exit(1)
+	}
+}
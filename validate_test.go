@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		errs   []string
+	}{
+		{
+			name:   "valid",
+			config: `{"http":{"routers":{"a.flakery.xyz":{"service":"a"}},"services":{"a":{"servers":[{"url":"http://10.0.0.1:8080"}]}}}}`,
+		},
+		{
+			name:   "missing service",
+			config: `{"http":{"routers":{"a.flakery.xyz":{"service":"b"}},"services":{"a":{"servers":[{"url":"http://10.0.0.1:8080"}]}}}}`,
+			errs:   []string{"router a.flakery.xyz: service b does not exist"},
+		},
+		{
+			name:   "bad servers",
+			config: `{"http":{"services":{"a":{"servers":[{"url":"10.0.0.1:8080"},{"url":"http://"}]},"b":{"servers":[]}}}}`,
+			errs:   []string{`service a: server "10.0.0.1:8080"`, `service a: server "http://": no host`, "service b: no servers"},
+		},
+		{
+			name:   "drained servers",
+			config: `{"http":{"routers":{"a.flakery.xyz":{"service":"a"}},"services":{"a":{"servers":[{"url":"http://10.0.0.1:8080","weight":0},{"url":"http://10.0.0.2:8080"}]},"b":{"servers":[{"url":"http://10.0.0.3:8080","weight":0}]}}}}`,
+			errs:   []string{"service b: no server with a weight"},
+		},
+		{
+			name:   "hosts equal once normalized",
+			config: `{"http":{"routers":{"Foo.flakery.xyz":{"service":"a"},"foo.flakery.xyz.":{"service":"a"},"ｂａｒ.flakery.xyz":{"service":"a"},"bar.flakery.xyz":{"service":"a"}},"services":{"a":{"servers":[{"url":"http://10.0.0.1:8080"}]}}}}`,
+			errs: []string{
+				"routers Foo.flakery.xyz and foo.flakery.xyz. are both for host foo.flakery.xyz",
+				"routers bar.flakery.xyz and ｂａｒ.flakery.xyz are both for host bar.flakery.xyz",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseConfig([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = validateConfig(c)
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %q", tt.errs)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigDuplicateHosts(t *testing.T) {
+	_, err := parseConfig([]byte(`{"http":{"routers":{"a.flakery.xyz":{"service":"a"},"a.flakery.xyz":{"service":"b"}}}}`))
+	if err == nil || !strings.Contains(err.Error(), `$.http.routers: "a.flakery.xyz" is defined more than once`) {
+		t.Fatalf("expected a duplicate router error, got %v", err)
+	}
+}
+
+func TestCheckConfigStdin(t *testing.T) {
+	var out bytes.Buffer
+	in := strings.NewReader(`{"http":{"routers":{"a.flakery.xyz":{"service":"a"}},"services":{"a":{"servers":[{"url":"http://10.0.0.1:8080"}]}}}}`)
+	if err := checkConfig("-", in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "-: ok, 1 routers, 1 services\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}